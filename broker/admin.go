@@ -0,0 +1,204 @@
+package broker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"../config"
+	"../dto"
+)
+
+// AdminServer is the management API of the broker, every request must carry the token.
+//
+//	GET    /nodes              the clients and servers connected
+//	DELETE /nodes/{id}         disconnects the node
+//	POST   /nodes/{id}/drain   gives no new connection to the server
+//	DELETE /nodes/{id}/drain   gives new connections to the server again
+//	GET    /connections        the connections relayed
+//	DELETE /connections/{id}   closes the connection on both ends
+type AdminServer struct {
+	broker *ProxyBroker
+	token  string
+}
+
+type nodeStatus struct {
+	ID          string    `json:"id"`
+	Role        string    `json:"role"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	BytesIn     int64     `json:"bytesIn"`  // read from the node
+	BytesOut    int64     `json:"bytesOut"` // written to the node
+	Connections int       `json:"connections"`
+	Draining    bool      `json:"draining"`
+}
+
+type connectionStatus struct {
+	ID          int64     `json:"id"`
+	Type        string    `json:"type"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Target      string    `json:"target"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Pending     bool      `json:"pending"` // no reply yet
+}
+
+func (this *ProxyBroker) serveAdmin(admin config.Admin) {
+	log.Println("Broker admin API is listening on", admin.Listen)
+	httpServer := &http.Server{
+		Addr: admin.Listen,
+		Handler: &AdminServer{
+			broker: this,
+			token:  admin.Token,
+		},
+		ReadTimeout:    30 * time.Second,
+		WriteTimeout:   30 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	log.Println(httpServer.ListenAndServe())
+}
+
+func (this *AdminServer) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(this.token)) != 1 {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "nodes" && req.Method == http.MethodGet:
+		this.reply(writer, this.listNodes())
+
+	case len(path) == 2 && path[0] == "nodes" && req.Method == http.MethodDelete:
+		this.kickNode(writer, req, path[1])
+
+	case len(path) == 3 && path[0] == "nodes" && path[2] == "drain" && (req.Method == http.MethodPost || req.Method == http.MethodDelete):
+		this.drainServer(writer, req, path[1], req.Method == http.MethodPost)
+
+	case len(path) == 1 && path[0] == "connections" && req.Method == http.MethodGet:
+		this.reply(writer, this.listConnections())
+
+	case len(path) == 2 && path[0] == "connections" && req.Method == http.MethodDelete:
+		this.closeConnection(writer, req, path[1])
+
+	default:
+		http.Error(writer, "Not Found", http.StatusNotFound)
+	}
+}
+
+func (this *AdminServer) reply(writer http.ResponseWriter, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Println(err)
+	}
+}
+
+func (this *AdminServer) listNodes() []nodeStatus {
+	counts := make(map[string]int)
+	for _, conn := range this.broker.connectionSet.list() {
+		counts[conn.sourceNodeID]++
+		counts[conn.destNodeID]++
+	}
+
+	nodes := make([]nodeStatus, 0)
+	for _, node := range this.broker.nodeSet.list() {
+		role := "client"
+		if node.isServer {
+			role = "server"
+		}
+		nodes = append(nodes, nodeStatus{
+			ID:          node.id,
+			Role:        role,
+			RemoteAddr:  node.remoteAddr,
+			ConnectedAt: node.connectedAt,
+			BytesIn:     atomic.LoadInt64(&node.bytesIn),
+			BytesOut:    atomic.LoadInt64(&node.bytesOut),
+			Connections: counts[node.id],
+			Draining:    node.isDraining(),
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ConnectedAt.Before(nodes[j].ConnectedAt) })
+	return nodes
+}
+
+func (this *AdminServer) listConnections() []connectionStatus {
+	conns := make([]connectionStatus, 0)
+	for connID, conn := range this.broker.connectionSet.list() {
+		conns = append(conns, connectionStatus{
+			ID:          connID,
+			Type:        conn.msgType.String(),
+			Source:      conn.sourceNodeID,
+			Destination: conn.destNodeID,
+			Target:      conn.target,
+			CreatedAt:   conn.createdAt,
+			Pending:     conn.pending,
+		})
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].CreatedAt.Before(conns[j].CreatedAt) })
+	return conns
+}
+
+func (this *AdminServer) kickNode(writer http.ResponseWriter, req *http.Request, id string) {
+	node := this.broker.nodeSet.get(id)
+	if node == nil {
+		http.Error(writer, fmt.Sprintf("Node %v is not connected", id), http.StatusNotFound)
+		return
+	}
+	log.Println("Node", id, "at", node.remoteAddr, "is disconnected by", req.RemoteAddr)
+	node.conn.Close() // the reader exits, and the connections of the node are closed
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (this *AdminServer) drainServer(writer http.ResponseWriter, req *http.Request, id string, draining bool) {
+	node := this.broker.nodeSet.get(id)
+	if node == nil || !node.isServer {
+		http.Error(writer, fmt.Sprintf("Server %v is not connected", id), http.StatusNotFound)
+		return
+	}
+	node.drain(draining)
+	if draining {
+		log.Println("Server", id, "is drained by", req.RemoteAddr, ", it takes no new connections")
+	} else {
+		log.Println("Server", id, "takes new connections again, as asked by", req.RemoteAddr)
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (this *AdminServer) closeConnection(writer http.ResponseWriter, req *http.Request, value string) {
+	connID, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid connection id %v", value), http.StatusBadRequest)
+		return
+	}
+	conn := this.broker.connectionSet.remove(connID)
+	if conn == nil {
+		http.Error(writer, fmt.Sprintf("Connection %v is not found", connID), http.StatusNotFound)
+		return
+	}
+	pending := this.broker.connectionSet.replied(conn)
+	log.Println("Connection", connID, "to", conn.target, "is closed by", req.RemoteAddr)
+
+	// the end waiting for the reply is told the connection failed
+	payload := &dto.Payload{
+		ErrorCode:    dto.ErrorCode_GENERAL_FAILURE,
+		ErrorMessage: "The connection is closed by the administrator of the broker",
+	}
+	sourceType := dto.Type_TCP_CONNECTION_CLOSED
+	if pending {
+		sourceType = dto.Type_TCP_CONNECTION_FAILED
+	}
+	this.broker.send(conn.sourceNodeID, sourceType, connID, payload)
+	this.broker.send(this.broker.connectionSet.destOf(conn), dto.Type_TCP_CONNECTION_CLOSED, connID, payload)
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -4,10 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"../comm"
+	"../config"
 	"../dto"
 	"github.com/gorilla/websocket"
 )
@@ -16,12 +21,19 @@ type ProxyBroker struct {
 	nodeSet       *NodeSet
 	connectionSet *ConnectionSet
 	upgrader      websocket.Upgrader
+	reversePolicy *ReversePolicy
+	batching      config.Batching
 }
 
 func Run(bindPort uint16) error {
 	this := &ProxyBroker{}
-	this.nodeSet = NewNodeSet()
+	this.nodeSet = NewNodeSet(config.GetScheduling())
 	this.connectionSet = NewConnectionSet()
+	this.reversePolicy = NewReversePolicy(config.GetReverseGrants())
+	this.batching = config.GetBatching()
+	if admin := config.GetAdmin(); len(admin.Listen) > 0 {
+		go this.serveAdmin(admin)
+	}
 	this.upgrader = websocket.Upgrader{
 		ReadBufferSize:    1024 * 1024,
 		WriteBufferSize:   1024 * 1024,
@@ -49,18 +61,38 @@ func (this *ProxyBroker) ServeHTTP(writer http.ResponseWriter, req *http.Request
 	//TODO: verify the request
 
 	if len(id) > 0 {
-		wsConn, err := this.upgrader.Upgrade(writer, req, nil)
+		// nodes which do not announce a version only speak the legacy header
+		version := dto.NegotiateVersion(req.URL.Query().Get(dto.VersionParam))
+		responseHeader := make(http.Header)
+		responseHeader.Set(dto.VersionHeader, strconv.Itoa(dto.HeaderVersion))
+		responseHeader.Set(dto.BatchHeader, "1")
+		wsConn, err := this.upgrader.Upgrade(writer, req, responseHeader)
 		if err != nil {
 			log.Println(err)
 			return
 		}
 		defer wsConn.Close()
 
-		node := this.nodeSet.add(id, isServer)
+		node := this.nodeSet.add(id, isServer, req.RemoteAddr, version, wsConn)
+		node.queue.OnResume(func(connID int64) { this.resumeSender(id, connID) })
 		defer (func() {
-			this.nodeSet.remove(node)
+			if this.nodeSet.remove(node) {
+				this.closeConnectionsOf(id)
+			}
 		})()
 
+		// small messages are coalesced if the node accepts batches
+		maxBatchSize := 0
+		if req.URL.Query().Get(dto.BatchParam) == "1" {
+			maxBatchSize = this.batching.MaxSize
+		}
+		batcher := dto.NewBatcher(maxBatchSize, this.batching.GetFlushDelay(), func(buf []byte) error {
+			atomic.AddInt64(&node.bytesOut, int64(len(buf)))
+			err := wsConn.WriteMessage(websocket.BinaryMessage, buf)
+			dto.Release(buf)
+			return err
+		})
+
 		readerExitedChannel := make(chan bool)
 		exited := false
 		go (func() {
@@ -69,17 +101,36 @@ func (this *ProxyBroker) ServeHTTP(writer http.ResponseWriter, req *http.Request
 			for !exited {
 
 				select {
-				case buf, more := <-node.channel:
+				case <-node.queue.Ready():
 					{
-						if more {
-							// then send the chunk data
-							err := wsConn.WriteMessage(websocket.BinaryMessage, buf)
+						// then send the chunk data in the order the scheduler picks
+						for {
+							buf, more := node.queue.Pop()
+							if !more {
+								log.Println(id, "writer goroutine exited because the queue was closed")
+								return
+							}
+							if buf == nil {
+								break
+							}
+							// the header is converted for nodes which do not speak the latest version
+							buf, err := dto.ForVersion(buf, node.version)
+							if err != nil {
+								log.Println(id, err)
+								continue
+							}
+							err = batcher.Write(buf)
 							if err != nil {
 								log.Println(id, err)
 								return
 							}
-						} else {
-							log.Println(id, "writer goroutine exited because channel was closed")
+						}
+					} // case end
+				case <-batcher.Deadline():
+					{
+						err := batcher.Flush()
+						if err != nil {
+							log.Println(id, err)
 							return
 						}
 					} // case end
@@ -110,15 +161,30 @@ func (this *ProxyBroker) ServeHTTP(writer http.ResponseWriter, req *http.Request
 				break
 			}
 
-			mt, buffer, err := wsConn.ReadMessage()
+			mt, reader, err := wsConn.NextReader()
 			if err != nil {
 				log.Println(err)
 				break
 			}
 
 			if mt == websocket.BinaryMessage {
-
-				err = this.handleInboundMessage(id, buffer)
+				// the buffer is released by the writer of the node it is forwarded to
+				buffer, err := dto.ReadFrame(reader)
+				if err != nil {
+					log.Println(err)
+					break
+				}
+				atomic.AddInt64(&node.bytesIn, int64(len(buffer)))
+
+				if dto.IsBatch(buffer) {
+					// each message is forwarded on its own, and may be batched again for the node it is sent to
+					err = dto.Unbatch(buffer, func(frame []byte) error {
+						return this.handleInboundMessage(id, append(dto.GetBuffer(len(frame)), frame...))
+					})
+					dto.Release(buffer)
+				} else {
+					err = this.handleInboundMessage(id, buffer)
+				}
 				if err != nil {
 					log.Println(err)
 					break
@@ -156,6 +222,36 @@ func (this *ProxyBroker) handleInboundMessage(nodeID string, buffer []byte) erro
 	case dto.Type_INBOUND_DATA:
 		return this.handleData(nodeID, header, buffer)
 
+	case dto.Type_DNS_QUERY:
+		return this.handleConnecting(nodeID, header, buffer)
+
+	case dto.Type_DNS_RESPONSE:
+		return this.handleConnectionStatusChange(nodeID, header, buffer)
+
+	case dto.Type_UDP_ASSOCIATE:
+		return this.handleConnecting(nodeID, header, buffer)
+
+	case dto.Type_UDP_DATAGRAM:
+		return this.handleData(nodeID, header, buffer)
+
+	case dto.Type_TCP_BIND:
+		return this.handleConnecting(nodeID, header, buffer)
+
+	case dto.Type_TCP_BOUND:
+		return this.handleConnectionStatusChange(nodeID, header, buffer)
+
+	case dto.Type_REVERSE_LISTEN:
+		return this.handleReverseListen(nodeID, header, buffer)
+
+	case dto.Type_REVERSE_CONNECT:
+		return this.handleReverseConnect(nodeID, header, buffer)
+
+	case dto.Type_FLOW_PAUSE:
+		return this.handleData(nodeID, header, buffer)
+
+	case dto.Type_FLOW_RESUME:
+		return this.handleData(nodeID, header, buffer)
+
 	default:
 		log.Println("Unknown command type", header.Type)
 		return nil
@@ -166,12 +262,13 @@ func (this *ProxyBroker) handleConnecting(nodeID string, header *dto.MessageHead
 
 	srv := this.nodeSet.getServer()
 	if srv == nil {
-		srcChannel := this.nodeSet.getChannel(nodeID)
-		if srcChannel == nil {
-			return errors.New("Unable to found the source channel")
+		srcQueue := this.nodeSet.getQueue(nodeID)
+		if srcQueue == nil {
+			return errors.New("Unable to found the source queue")
 		}
 		// no server to handle
 		payload := &dto.Payload{
+			ErrorCode:    dto.ErrorCode_NO_SERVER_AVAILABLE,
 			ErrorMessage: "There is no server to handle connection at this moment",
 		}
 		bytes, err := dto.Encode(dto.Type_TCP_CONNECTION_FAILED, header.ConnectionID, payload)
@@ -179,33 +276,69 @@ func (this *ProxyBroker) handleConnecting(nodeID string, header *dto.MessageHead
 			return err
 		}
 
-		srcChannel <- bytes
+		srcQueue.Push(header.ConnectionID, dto.Type_TCP_CONNECTION_FAILED, bytes)
 	} else {
-		// timer to check if no response
-		timer := time.AfterFunc(30*time.Second, func() {
-			conn := this.connectionSet.remove(header.ConnectionID)
-			if conn != nil {
-				srcChannel := this.nodeSet.getChannel(nodeID)
-				if srcChannel != nil {
-					payload := &dto.Payload{
-						ErrorMessage: fmt.Sprintf("Connection %v does not receive any reply from server after 30 seconds", header.ConnectionID),
-					}
-					bytes, err := dto.Encode(dto.Type_TCP_CONNECTION_FAILED, header.ConnectionID, payload)
-					if err == nil {
-						srcChannel <- bytes
-					}
-				}
-			}
-		})
-
 		// record the connection
-		this.connectionSet.add(header.ConnectionID, nodeID, srv.id, timer)
-		srv.channel <- buffer
+		request := buffer
+		target := ""
+		msg, err := dto.Decode(buffer)
+		if err == nil && msg != nil {
+			request = this.stampSource(nodeID, msg, buffer)
+			this.classify(header.ConnectionID, msg.Payload, nodeID, srv.id)
+			target = net.JoinHostPort(msg.Payload.Address, strconv.Itoa(int(msg.Payload.Port)))
+		}
+		kept := append([]byte(nil), request...) // kept to retry, the one sent is released once written
+		this.connectionSet.add(header.ConnectionID, header.Type, nodeID, srv.id, target, kept, this.awaitReply(nodeID, header.ConnectionID))
+		srv.queue.Push(header.ConnectionID, header.Type, request)
 	}
 
 	return nil
 }
 
+// awaitReply fails the connection if no server replies within 30 seconds
+func (this *ProxyBroker) awaitReply(nodeID string, connID int64) *time.Timer {
+	return time.AfterFunc(30*time.Second, func() {
+		conn := this.connectionSet.remove(connID)
+		if conn != nil {
+			srcQueue := this.nodeSet.getQueue(nodeID)
+			if srcQueue != nil {
+				payload := &dto.Payload{
+					ErrorCode:    dto.ErrorCode_TIMEOUT,
+					ErrorMessage: fmt.Sprintf("Connection %v does not receive any reply from server after 30 seconds", connID),
+				}
+				bytes, err := dto.Encode(dto.Type_TCP_CONNECTION_FAILED, connID, payload)
+				if err == nil {
+					srcQueue.Push(connID, dto.Type_TCP_CONNECTION_FAILED, bytes)
+				}
+			}
+		}
+	})
+}
+
+// retryIfBusy sends the request to another server if the server replied it is busy
+func (this *ProxyBroker) retryIfBusy(nodeID string, header *dto.MessageHeader, buffer []byte, conn *ConnectionInfo) bool {
+	kept, triedServers := this.connectionSet.pendingRequest(conn)
+	if header.Type != dto.Type_TCP_CONNECTION_FAILED || nodeID != this.connectionSet.destOf(conn) || kept == nil {
+		return false
+	}
+	msg, err := dto.Decode(buffer)
+	if err != nil || msg == nil || msg.Payload.ErrorCode != dto.ErrorCode_SERVER_BUSY {
+		return false
+	}
+	srv := this.nodeSet.getServerExcept(append(triedServers, nodeID))
+	if srv == nil {
+		return false
+	}
+	log.Println("Server", nodeID, "is busy,", msg.Payload.ErrorMessage, ", connection", header.ConnectionID, "is tried on server", srv.id)
+	request, err := dto.DecodeHeader(kept)
+	if err != nil {
+		return false
+	}
+	this.connectionSet.redirect(header.ConnectionID, srv.id, this.awaitReply(conn.sourceNodeID, header.ConnectionID))
+	srv.queue.Push(header.ConnectionID, request.Type, append([]byte(nil), kept...))
+	return true
+}
+
 // connection is successfully established
 func (this *ProxyBroker) handleConnectionStatusChange(nodeID string, header *dto.MessageHeader, buffer []byte) error {
 
@@ -213,43 +346,49 @@ func (this *ProxyBroker) handleConnectionStatusChange(nodeID string, header *dto
 	//log.Println(header.ConnectionID, header.Type, conn)
 	if conn != nil {
 
-		timer := conn.timer
-		if timer != nil {
-			timer.Stop()
-			conn.timer = nil
+		this.connectionSet.replied(conn)
+		if this.retryIfBusy(nodeID, header, buffer, conn) {
+			return nil
 		}
+		this.connectionSet.settled(conn)
 
 		// find the other end
 		destNodeID := conn.sourceNodeID
 		if destNodeID == nodeID {
-			destNodeID = conn.destNodeID
+			destNodeID = this.connectionSet.destOf(conn)
 		}
 		srv := this.nodeSet.get(destNodeID)
 		if srv != nil {
-			srv.channel <- buffer
+			srv.queue.Push(header.ConnectionID, header.Type, buffer)
 		} else {
-			srcChannel := this.nodeSet.getChannel(nodeID)
-			if srcChannel != nil {
+			srcQueue := this.nodeSet.getQueue(nodeID)
+			if srcQueue != nil {
 				payload := &dto.Payload{
+					ErrorCode:    dto.ErrorCode_CONNECTION_NOT_FOUND,
 					ErrorMessage: fmt.Sprintf("Broker is unable to find the other end %v", destNodeID),
 				}
 				bytes, err := dto.Encode(dto.Type_TCP_CONNECTION_CLOSED, header.ConnectionID, payload)
 				if err != nil {
 					return err
 				}
-				srcChannel <- bytes
+				srcQueue.Push(header.ConnectionID, dto.Type_TCP_CONNECTION_CLOSED, bytes)
 			}
 
 		}
 
 		if header.Type == dto.Type_TCP_CONNECTION_FAILED ||
-			header.Type == dto.Type_TCP_CONNECTION_CLOSED {
+			header.Type == dto.Type_TCP_CONNECTION_CLOSED ||
+			header.Type == dto.Type_DNS_RESPONSE {
 			this.connectionSet.remove(header.ConnectionID)
+			if srcQueue := this.nodeSet.getQueue(nodeID); srcQueue != nil {
+				srcQueue.Forget(header.ConnectionID)
+			}
 		}
 	} else if header.Type != dto.Type_TCP_CONNECTION_CLOSED {
-		srcChannel := this.nodeSet.getChannel(nodeID)
-		if srcChannel != nil {
+		srcQueue := this.nodeSet.getQueue(nodeID)
+		if srcQueue != nil {
 			payload := &dto.Payload{
+				ErrorCode:    dto.ErrorCode_CONNECTION_NOT_FOUND,
 				ErrorMessage: fmt.Sprintf("Broker is unable to find the connection %v", header.ConnectionID),
 			}
 			bytes, err := dto.Encode(dto.Type_TCP_CONNECTION_CLOSED, header.ConnectionID, payload)
@@ -257,40 +396,181 @@ func (this *ProxyBroker) handleConnectionStatusChange(nodeID string, header *dto
 				return err
 			}
 
-			srcChannel <- bytes
+			srcQueue.Push(header.ConnectionID, dto.Type_TCP_CONNECTION_CLOSED, bytes)
 		}
 	}
 
 	return nil
 }
 
+// handleData forwards the data to the other end, it never waits for the other end to read,
+// the reader of the node is shared by its connections. The sender is paused while too much is queued
 func (this *ProxyBroker) handleData(nodeID string, header *dto.MessageHeader, buffer []byte) error {
 	conn := this.connectionSet.get(header.ConnectionID)
 	if conn != nil {
 
 		// find the other end
-		destNodeID := conn.destNodeID
+		destNodeID := this.connectionSet.destOf(conn)
 		if destNodeID == nodeID {
 			destNodeID = conn.sourceNodeID
 		}
 		srv := this.nodeSet.get(destNodeID)
 		if srv != nil {
-			srv.channel <- buffer
+			pause, err := srv.queue.Offer(header.ConnectionID, header.Type, buffer)
+			if pause {
+				this.send(nodeID, dto.Type_FLOW_PAUSE, header.ConnectionID, nil)
+			}
+			if err != nil && header.Type != dto.Type_UDP_DATAGRAM { // a datagram is dropped alone
+				if this.connectionSet.remove(header.ConnectionID) != nil {
+					log.Println("Connection", header.ConnectionID, "to", conn.target, "is closed,", err.Error())
+					payload := dto.NewErrorPayload(err)
+					this.send(nodeID, dto.Type_TCP_CONNECTION_CLOSED, header.ConnectionID, payload)
+					this.send(destNodeID, dto.Type_TCP_CONNECTION_CLOSED, header.ConnectionID, payload)
+				}
+			}
 			return nil
 		}
 
 		this.connectionSet.remove(header.ConnectionID)
 	}
 
-	srcChannel := this.nodeSet.getChannel(nodeID)
-	if srcChannel != nil {
+	srcQueue := this.nodeSet.getQueue(nodeID)
+	if srcQueue != nil {
 		payload := &dto.Payload{
+			ErrorCode:    dto.ErrorCode_CONNECTION_NOT_FOUND,
 			ErrorMessage: "The connection is lost",
 		}
 		bytes, err := dto.Encode(dto.Type_TCP_CONNECTION_CLOSED, header.ConnectionID, payload)
 		if err == nil {
-			srcChannel <- bytes
+			srcQueue.Push(header.ConnectionID, dto.Type_TCP_CONNECTION_CLOSED, bytes)
+		}
+	}
+	return nil
+}
+
+// handleReverseListen forwards the request to listen to a server, if the address and the port are granted to the client.
+// The listener is recorded as a connection of the client, so that the server closes it once the client is disconnected
+func (this *ProxyBroker) handleReverseListen(nodeID string, header *dto.MessageHeader, buffer []byte) error {
+	msg, err := dto.Decode(buffer)
+	if err != nil {
+		return err
+	}
+	node := this.nodeSet.get(nodeID)
+	if node == nil {
+		return errors.New("Unable to found the source node")
+	}
+	address := net.JoinHostPort(msg.Payload.GetAddress(), strconv.Itoa(int(msg.Payload.GetPort())))
+	if !this.reversePolicy.allows(msg.Payload.GetAddress(), int(msg.Payload.GetPort()), node.remoteAddr) {
+		log.Println(nodeID, "from", node.remoteAddr, "is not granted to listen on", address)
+		payload := &dto.Payload{
+			ErrorCode:    dto.ErrorCode_NOT_ALLOWED,
+			ErrorMessage: fmt.Sprintf("Listening on %v is not granted", address),
+		}
+		return this.send(nodeID, dto.Type_TCP_CONNECTION_FAILED, header.ConnectionID, payload)
+	}
+	return this.handleConnecting(nodeID, header, buffer)
+}
+
+// handleReverseConnect opens a connection from the server to the client which asked the server to listen
+func (this *ProxyBroker) handleReverseConnect(nodeID string, header *dto.MessageHeader, buffer []byte) error {
+	msg, err := dto.Decode(buffer)
+	if err != nil {
+		return err
+	}
+	listener := this.connectionSet.get(msg.Payload.GetListenerID())
+	var clientQueue *comm.Scheduler
+	if listener != nil && this.connectionSet.destOf(listener) == nodeID {
+		clientQueue = this.nodeSet.getQueue(listener.sourceNodeID)
+	}
+	if clientQueue == nil {
+		payload := &dto.Payload{
+			ErrorCode:    dto.ErrorCode_CONNECTION_NOT_FOUND,
+			ErrorMessage: fmt.Sprintf("Broker is unable to find the listener %v", msg.Payload.GetListenerID()),
+		}
+		return this.send(nodeID, dto.Type_TCP_CONNECTION_FAILED, header.ConnectionID, payload)
+	}
+
+	// timer to check if no response
+	timer := time.AfterFunc(30*time.Second, func() {
+		if this.connectionSet.remove(header.ConnectionID) != nil {
+			payload := &dto.Payload{
+				ErrorCode:    dto.ErrorCode_TIMEOUT,
+				ErrorMessage: fmt.Sprintf("Connection %v does not receive any reply from client after 30 seconds", header.ConnectionID),
+			}
+			this.send(nodeID, dto.Type_TCP_CONNECTION_FAILED, header.ConnectionID, payload)
+		}
+	})
+	target := net.JoinHostPort(msg.Payload.Address, strconv.Itoa(int(msg.Payload.Port)))
+	this.connectionSet.add(header.ConnectionID, header.Type, nodeID, listener.sourceNodeID, target, nil, timer)
+	clientQueue.Push(header.ConnectionID, header.Type, buffer)
+	return nil
+}
+
+// closeConnectionsOf tells the other ends that the connections of the node are lost,
+// including the listeners a disconnected client asked the servers for
+func (this *ProxyBroker) closeConnectionsOf(nodeID string) {
+	for connID, conn := range this.connectionSet.removeByNode(nodeID) {
+		this.connectionSet.replied(conn)
+		otherNodeID := conn.sourceNodeID
+		if otherNodeID == nodeID {
+			otherNodeID = this.connectionSet.destOf(conn)
 		}
+		payload := &dto.Payload{
+			ErrorCode:    dto.ErrorCode_CONNECTION_NOT_FOUND,
+			ErrorMessage: fmt.Sprintf("The other end %v is disconnected", nodeID),
+		}
+		this.send(otherNodeID, dto.Type_TCP_CONNECTION_CLOSED, connID, payload)
+	}
+}
+
+// resumeSender tells the other end of the connection it may send again, once the data queued for the node is written
+func (this *ProxyBroker) resumeSender(nodeID string, connID int64) {
+	conn := this.connectionSet.get(connID)
+	if conn == nil {
+		return
+	}
+	senderID := conn.sourceNodeID
+	if senderID == nodeID {
+		senderID = this.connectionSet.destOf(conn)
+	}
+	this.send(senderID, dto.Type_FLOW_RESUME, connID, nil)
+}
+
+// send a message generated by the broker itself
+func (this *ProxyBroker) send(nodeID string, msgType dto.Type, connID int64, payload *dto.Payload) error {
+	bytes, err := dto.Encode(msgType, connID, payload)
+	if err != nil {
+		return err
+	}
+	queue := this.nodeSet.getQueue(nodeID)
+	if queue != nil {
+		queue.Push(connID, msgType, bytes)
 	}
 	return nil
 }
+
+// stampSource tells the server which client node asks, so that the connections can be traced.
+// Whatever the client claims is overwritten
+func (this *ProxyBroker) stampSource(nodeID string, msg *dto.Message, buffer []byte) []byte {
+	node := this.nodeSet.get(nodeID)
+	if node == nil {
+		return buffer
+	}
+	msg.Payload.SourceNode = node.id
+	msg.Payload.SourceAddress = node.remoteAddr
+	bytes, err := dto.Encode(msg.Header.Type, msg.Header.ConnectionID, msg.Payload)
+	if err != nil {
+		return buffer
+	}
+	return bytes
+}
+
+// classify fixes the priority of the connection on the nodes if a rule matches its destination
+func (this *ProxyBroker) classify(connID int64, payload *dto.Payload, nodeIDs ...string) {
+	for _, nodeID := range nodeIDs {
+		queue := this.nodeSet.getQueue(nodeID)
+		if queue != nil {
+			queue.Classify(connID, payload.Address, int(payload.Port))
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package broker
+
+import (
+	"testing"
+
+	"../config"
+	"../dto"
+)
+
+// relayTo writes the frames queued for the node like the writer of the broker, done is closed once n are written
+func relayTo(node *Node, n int, done chan<- struct{}) {
+	batcher := dto.NewBatcher(0, 0, func(buf []byte) error {
+		dto.Release(buf)
+		return nil
+	})
+	count := 0
+	for range node.queue.Ready() {
+		for {
+			buf, more := node.queue.Pop()
+			if !more {
+				return
+			}
+			if buf == nil {
+				break
+			}
+			buf, err := dto.ForVersion(buf, node.version)
+			if err != nil {
+				continue
+			}
+			batcher.Write(buf)
+			if count++; count == n {
+				close(done)
+			}
+		}
+	}
+}
+
+// waitResumed reads what the broker sent to the client, and waits like the client while the broker asks to pause
+func waitResumed(client *Node) {
+	for paused := false; ; {
+		buf, more := client.queue.Pop()
+		if !more {
+			return
+		}
+		if buf == nil {
+			if !paused {
+				return
+			}
+			<-client.queue.Ready()
+			continue
+		}
+		header, _ := dto.DecodeHeader(buf)
+		dto.Release(buf)
+		switch header.Type {
+		case dto.Type_FLOW_PAUSE:
+			paused = true
+		case dto.Type_FLOW_RESUME:
+			paused = false
+		}
+	}
+}
+
+func BenchmarkRelay(b *testing.B) {
+	tests := []struct {
+		name          string
+		sentVersion   int // the header the client sends
+		serverVersion int // the header the server speaks
+	}{
+		{"legacy", dto.LegacyHeader, dto.LegacyHeader},
+		{"v1", dto.FixedHeader, dto.FixedHeader},
+		{"v1 to legacy", dto.FixedHeader, dto.LegacyHeader},
+	}
+	for _, test := range tests {
+		b.Run(test.name, func(b *testing.B) {
+			this := &ProxyBroker{
+				nodeSet:       NewNodeSet(config.Scheduling{}),
+				connectionSet: NewConnectionSet(),
+			}
+			client := this.nodeSet.add("client", false, "192.0.2.1:5000", test.sentVersion, nil)
+			server := this.nodeSet.add("server", true, "192.0.2.2:5000", test.serverVersion, nil)
+			server.queue.OnResume(func(connID int64) { this.resumeSender("server", connID) })
+			this.connectionSet.add(1, dto.Type_TCP_CONNECT, "client", "server", "example.com:80", nil, nil)
+			defer this.nodeSet.remove(server)
+
+			frame, err := dto.Encode(dto.Type_OUTBOUND_DATA, 1, &dto.Payload{Data: make([]byte, 16*1024)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if frame, err = dto.ForVersion(frame, test.sentVersion); err != nil {
+				b.Fatal(err)
+			}
+			done := make(chan struct{})
+			go relayTo(server, b.N, done)
+
+			b.SetBytes(int64(len(frame)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// the reader hands over a pooled buffer, which the writer releases
+				buffer := append(dto.GetBuffer(len(frame)), frame...)
+				if err := this.handleInboundMessage("client", buffer); err != nil {
+					b.Fatal(err)
+				}
+				waitResumed(client)
+			}
+			<-done
+		})
+	}
+}
@@ -3,6 +3,8 @@ package broker
 import (
 	"sync"
 	"time"
+
+	"../dto"
 )
 
 type ConnectionSet struct {
@@ -10,10 +12,27 @@ type ConnectionSet struct {
 	mutex sync.RWMutex
 }
 
+// ConnectionInfo is shared by the readers of both ends. The fields after createdAt change while the connection is relayed,
+// they are accessed under the mutex of the set by its methods
 type ConnectionInfo struct {
+	msgType      dto.Type // the request which opened the connection
 	sourceNodeID string
+	target       string // the address requested, "host:port"
+	createdAt    time.Time
 	destNodeID   string
 	timer        *time.Timer
+	request      []byte   // the request sent to the server, kept until it replies, to try another server if it is busy
+	triedServers []string // the servers which were busy
+}
+
+// connectionSnapshot is a copy of a connection, for the admin API
+type connectionSnapshot struct {
+	msgType      dto.Type
+	sourceNodeID string
+	destNodeID   string
+	target       string
+	createdAt    time.Time
+	pending      bool // no reply yet
 }
 
 func NewConnectionSet() *ConnectionSet {
@@ -23,19 +42,72 @@ func NewConnectionSet() *ConnectionSet {
 	return instance
 }
 
-func (this *ConnectionSet) add(connID int64, sourceNodeID string, destNodeID string, timer *time.Timer) *ConnectionInfo {
+// add records the connection, with the request kept to retry if it is not nil
+func (this *ConnectionSet) add(connID int64, msgType dto.Type, sourceNodeID string, destNodeID string, target string, request []byte, timer *time.Timer) *ConnectionInfo {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
 
 	conn := &ConnectionInfo{
+		msgType:      msgType,
 		sourceNodeID: sourceNodeID,
 		destNodeID:   destNodeID,
+		target:       target,
+		createdAt:    time.Now(),
 		timer:        timer,
+		request:      request,
 	}
 	this.set[connID] = conn
 	return conn
 }
 
+// redirect records the connection is handled by another server
+func (this *ConnectionSet) redirect(connID int64, destNodeID string, timer *time.Timer) *ConnectionInfo {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	conn := this.set[connID]
+	if conn != nil {
+		conn.triedServers = append(conn.triedServers, conn.destNodeID)
+		conn.destNodeID = destNodeID
+		conn.timer = timer
+	}
+	return conn
+}
+
+// destOf returns the node the connection is handled by
+func (this *ConnectionSet) destOf(conn *ConnectionInfo) string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return conn.destNodeID
+}
+
+// pendingRequest returns the request kept to retry and the servers tried already, nil once replied
+func (this *ConnectionSet) pendingRequest(conn *ConnectionInfo) ([]byte, []string) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return conn.request, append([]string(nil), conn.triedServers...)
+}
+
+// replied stops waiting for the reply, and tells if it was awaited
+func (this *ConnectionSet) replied(conn *ConnectionInfo) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if conn.timer == nil {
+		return false
+	}
+	conn.timer.Stop()
+	conn.timer = nil
+	return true
+}
+
+// settled drops the request kept to retry, once the connection is established or has failed for good
+func (this *ConnectionSet) settled(conn *ConnectionInfo) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	conn.request = nil
+}
+
 func (this *ConnectionSet) remove(connID int64) *ConnectionInfo {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
@@ -53,3 +125,37 @@ func (this *ConnectionSet) get(connID int64) *ConnectionInfo {
 	defer this.mutex.RUnlock()
 	return this.set[connID]
 }
+
+// removeByNode removes the connections either end of which is the node
+func (this *ConnectionSet) removeByNode(nodeID string) map[int64]*ConnectionInfo {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	removed := make(map[int64]*ConnectionInfo)
+	for connID, conn := range this.set {
+		if conn.sourceNodeID == nodeID || conn.destNodeID == nodeID {
+			removed[connID] = conn
+			delete(this.set, connID)
+		}
+	}
+	return removed
+}
+
+// list returns a snapshot of the connections
+func (this *ConnectionSet) list() map[int64]connectionSnapshot {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	conns := make(map[int64]connectionSnapshot, len(this.set))
+	for connID, conn := range this.set {
+		conns[connID] = connectionSnapshot{
+			msgType:      conn.msgType,
+			sourceNodeID: conn.sourceNodeID,
+			destNodeID:   conn.destNodeID,
+			target:       conn.target,
+			createdAt:    conn.createdAt,
+			pending:      conn.timer != nil,
+		}
+	}
+	return conns
+}
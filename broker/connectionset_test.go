@@ -0,0 +1,42 @@
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"../dto"
+)
+
+func TestConnectionSetList(t *testing.T) {
+	set := NewConnectionSet()
+	conn := set.add(1, dto.Type_TCP_CONNECT, "client", "server", "example.com:443", []byte("request"), time.NewTimer(time.Minute))
+
+	// the admin API lists while the readers of both ends change the connection
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go (func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			set.list()
+		}
+	})()
+	go (func() {
+		defer wg.Done()
+		set.redirect(1, "other", time.NewTimer(time.Minute))
+		set.replied(conn)
+		set.settled(conn)
+	})()
+	wg.Wait()
+
+	snapshot := set.list()[1]
+	if snapshot.destNodeID != "other" || snapshot.pending || snapshot.target != "example.com:443" {
+		t.Errorf("got %+v", snapshot)
+	}
+	if request, tried := set.pendingRequest(conn); request != nil || len(tried) != 1 || tried[0] != "server" {
+		t.Errorf("got request %q tried %v", request, tried)
+	}
+	if set.replied(conn) {
+		t.Error("the reply is awaited twice")
+	}
+}
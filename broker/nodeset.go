@@ -1,44 +1,63 @@
 package broker
 
 import (
+	"io"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"../comm"
+	"../config"
 )
 
 type NodeSet struct {
-	set     map[string]*Node
-	servers []*Node
-	mutex   sync.RWMutex
+	set        map[string]*Node
+	servers    []*Node
+	scheduling config.Scheduling
+	mutex      sync.RWMutex
 }
 
 type Node struct {
-	id       string
-	channel  chan []byte
-	isServer bool
+	id          string
+	queue       *comm.Scheduler // the frames to write to the node
+	isServer    bool
+	remoteAddr  string
+	version     int // version of the frame headers the node speaks
+	conn        io.Closer
+	connectedAt time.Time
+	bytesIn     int64 // read from the node
+	bytesOut    int64 // written to the node
+	draining    int32 // set if the server takes no new connections
 }
 
-func NewNodeSet() *NodeSet {
+func NewNodeSet(scheduling config.Scheduling) *NodeSet {
 	instance := &NodeSet{}
+	instance.scheduling = scheduling
 	instance.servers = make([]*Node, 0, 100)
 	instance.set = make(map[string]*Node)
 	instance.mutex = sync.RWMutex{}
 	return instance
 }
 
-func (this *NodeSet) add(id string, isServer bool) *Node {
+func (this *NodeSet) add(id string, isServer bool, remoteAddr string, version int, conn io.Closer) *Node {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
 
 	node := &Node{
-		id:       id,
-		isServer: isServer,
+		id:          id,
+		isServer:    isServer,
+		remoteAddr:  remoteAddr,
+		version:     version,
+		conn:        conn,
+		connectedAt: time.Now(),
 	}
-	node.channel = make(chan []byte, 10)
+	node.queue = comm.NewScheduler(this.scheduling)
 	originalNode := this.set[id]
 	this.set[id] = node
 	if originalNode != nil {
 		this.removeFromServerList(originalNode)
-		if originalNode.channel != nil {
-			close(originalNode.channel)
+		if originalNode.queue != nil {
+			originalNode.queue.Close()
 		}
 	}
 
@@ -61,7 +80,8 @@ func (this *NodeSet) removeFromServerList(node *Node) {
 	}
 }
 
-func (this *NodeSet) remove(node *Node) {
+// remove tells if the node is removed, it is not if another node of the same id has replaced it
+func (this *NodeSet) remove(node *Node) bool {
 	if node != nil {
 		this.mutex.Lock()
 		defer this.mutex.Unlock()
@@ -70,11 +90,13 @@ func (this *NodeSet) remove(node *Node) {
 		if currentNode == node {
 			delete(this.set, node.id)
 			this.removeFromServerList(node)
-			if currentNode.channel != nil {
-				close(currentNode.channel)
+			if currentNode.queue != nil {
+				currentNode.queue.Close()
 			}
+			return true
 		}
 	}
+	return false
 }
 
 func (this *NodeSet) get(id string) *Node {
@@ -83,21 +105,62 @@ func (this *NodeSet) get(id string) *Node {
 	return this.set[id]
 }
 
-func (this *NodeSet) getChannel(id string) chan []byte {
+func (this *NodeSet) getQueue(id string) *comm.Scheduler {
 	this.mutex.RLock()
 	defer this.mutex.RUnlock()
 	node := this.set[id]
 	if node != nil {
-		return node.channel
+		return node.queue
 	}
 	return nil
 }
 
 func (this *NodeSet) getServer() *Node {
+	return this.getServerExcept(nil)
+}
+
+// getServerExcept returns a server other than the excluded ones
+func (this *NodeSet) getServerExcept(excluded []string) *Node {
 	this.mutex.RLock()
 	defer this.mutex.RUnlock()
-	if len(this.servers) > 0 {
-		return this.servers[0]
+	for _, server := range this.servers {
+		if server.isDraining() {
+			continue
+		}
+		found := false
+		for _, id := range excluded {
+			if server.id == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return server
+		}
 	}
 	return nil
 }
+
+// list returns the nodes connected
+func (this *NodeSet) list() []*Node {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	nodes := make([]*Node, 0, len(this.set))
+	for _, node := range this.set {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (this *Node) isDraining() bool {
+	return atomic.LoadInt32(&this.draining) != 0
+}
+
+// drain stops or resumes giving new connections to the server
+func (this *Node) drain(draining bool) {
+	value := int32(0)
+	if draining {
+		value = 1
+	}
+	atomic.StoreInt32(&this.draining, value)
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"net"
+
+	"../config"
+)
+
+// ReversePolicy decides the addresses and the ports a client may have a server listen on
+type ReversePolicy struct {
+	grants []reverseGrant
+}
+
+type reverseGrant struct {
+	from           int
+	to             int
+	allowedSources []*net.IPNet
+	addresses      []net.IP // all interfaces only if empty
+}
+
+func NewReversePolicy(grants []config.ReverseGrant) *ReversePolicy {
+	instance := &ReversePolicy{}
+	for _, grant := range grants {
+		from, to := grant.GetPortRange()
+		instance.grants = append(instance.grants, reverseGrant{
+			from:           from,
+			to:             to,
+			allowedSources: grant.GetAllowedSources(),
+			addresses:      grant.GetAddresses(),
+		})
+	}
+	return instance
+}
+
+// allows tells if listening on host and port is granted to the client connected from remoteAddr.
+// An empty host means all interfaces
+func (this *ReversePolicy) allows(host string, port int, remoteAddr string) bool {
+	address := net.IPv4zero
+	if len(host) > 0 {
+		address = net.ParseIP(host)
+		if address == nil {
+			return false // a name would be resolved by the server
+		}
+	}
+
+	source, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		source = remoteAddr
+	}
+	ip := net.ParseIP(source)
+
+	for _, grant := range this.grants {
+		if port < grant.from || port > grant.to || !grant.allowsAddress(address) {
+			continue
+		}
+		if len(grant.allowedSources) == 0 {
+			return true
+		}
+		for _, network := range grant.allowedSources {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (this *reverseGrant) allowsAddress(address net.IP) bool {
+	if len(this.addresses) == 0 {
+		return address.IsUnspecified()
+	}
+	for _, granted := range this.addresses {
+		if granted.Equal(address) || granted.IsUnspecified() && address.IsUnspecified() {
+			return true
+		}
+	}
+	return false
+}
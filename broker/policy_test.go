@@ -0,0 +1,37 @@
+package broker
+
+import (
+	"testing"
+
+	"../config"
+)
+
+func TestReversePolicyAllows(t *testing.T) {
+	policy := NewReversePolicy([]config.ReverseGrant{
+		{Ports: "8000-8100"},
+		{Ports: "9000", AllowedSources: []string{"10.0.0.0/8"}, Addresses: []string{"192.0.2.10", "::"}},
+	})
+	tests := []struct {
+		name       string
+		host       string
+		port       int
+		remoteAddr string
+		allowed    bool
+	}{
+		{"all interfaces", "", 8080, "198.51.100.1:5000", true},
+		{"unspecified IPv4", "0.0.0.0", 8080, "198.51.100.1:5000", true},
+		{"unspecified IPv6", "::", 8100, "198.51.100.1:5000", true},
+		{"port not granted", "", 8101, "198.51.100.1:5000", false},
+		{"address not granted", "127.0.0.1", 8080, "198.51.100.1:5000", false},
+		{"name", "localhost", 8080, "198.51.100.1:5000", false},
+		{"address granted", "192.0.2.10", 9000, "10.1.2.3:5000", true},
+		{"all interfaces granted", "", 9000, "10.1.2.3:5000", true},
+		{"other address", "192.0.2.11", 9000, "10.1.2.3:5000", false},
+		{"source not granted", "192.0.2.10", 9000, "198.51.100.1:5000", false},
+	}
+	for _, test := range tests {
+		if allowed := policy.allows(test.host, test.port, test.remoteAddr); allowed != test.allowed {
+			t.Errorf("%v : got %v, want %v", test.name, allowed, test.allowed)
+		}
+	}
+}
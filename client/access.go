@@ -0,0 +1,93 @@
+package client
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+)
+
+const proxyAuthenticateRealm string = "detour-proxy"
+
+// allowedListener drops connections from sources out of the allowed networks
+type allowedListener struct {
+	net.Listener
+	allowedSources []*net.IPNet
+}
+
+func newAllowedListener(listener net.Listener, allowedSources []*net.IPNet) net.Listener {
+	if len(allowedSources) == 0 {
+		return listener
+	}
+	return &allowedListener{
+		Listener:       listener,
+		allowedSources: allowedSources,
+	}
+}
+
+func (this *allowedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := this.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if isAllowedSource(conn.RemoteAddr(), this.allowedSources) {
+			return conn, nil
+		}
+		log.Println("Connection from", conn.RemoteAddr(), "is not allowed")
+		conn.Close()
+	}
+}
+
+// isAllowedSource tells if the address is in any of the networks, or the networks are not restricted
+func isAllowedSource(addr net.Addr, allowedSources []*net.IPNet) bool {
+	if len(allowedSources) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range allowedSources {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks the password of the user, comparing in constant time
+func (this *ProxyClient) authenticate(username, password string) bool {
+	expected, ok := this.users[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// authenticateHTTP checks `Proxy-Authorization`, and asks for credentials if they are missing or wrong
+func (this *ProxyClient) authenticateHTTP(w http.ResponseWriter, r *http.Request) bool {
+	if len(this.users) == 0 {
+		return true
+	}
+	username, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+	if ok && this.authenticate(username, password) {
+		return true
+	}
+	w.Header().Set("Proxy-Authenticate", "Basic realm=\""+proxyAuthenticateRealm+"\"")
+	http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+	return false
+}
+
+// parseProxyAuthorization parses the Basic credentials, the same way as Request.BasicAuth() does for `Authorization`
+func parseProxyAuthorization(value string) (username, password string, ok bool) {
+	request := &http.Request{Header: http.Header{}}
+	request.Header.Set("Authorization", value)
+	return request.BasicAuth()
+}
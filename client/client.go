@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -16,6 +15,7 @@ import (
 
 	"../comm"
 	"../config"
+	"../dto"
 	"../socks"
 
 	"github.com/satori/go.uuid"
@@ -23,17 +23,29 @@ import (
 
 type ProxyClient struct {
 	transport           comm.Transport
-	tcpListener         net.Listener
+	socksConf           *socks.SOCKSConf
 	inaccessibleHostMap map[string]bool
 	mutex               sync.RWMutex
-	gfwList             *GFWList
+	ruleSet             *RuleSet
+	dnsServer           *DnsServer
+	fakeIPs             *FakeIPPool
+	sniffing            bool
+	users               map[string]string
+	allowedSources      []*net.IPNet
+	forwarder           *Forwarder
+	reverseForwards     map[int64]*ReverseForward // by the id of the listener on the exit server
 }
 
-func Run(httpPort uint16, socksPort uint16, uri string) error {
+func Run(httpPort uint16, socksPort uint16, mixedPort uint16, uri string) error {
 	this := &ProxyClient{
 		inaccessibleHostMap: make(map[string]bool),
+		reverseForwards:     make(map[int64]*ReverseForward),
 		mutex:               sync.RWMutex{},
+		users:               config.GetUsers(),
+		allowedSources:      config.GetAllowedSources(),
+		sniffing:            config.GetSniffing(),
 	}
+	bindAddress := config.GetBindAddress()
 
 	domains := config.GetInaccessibleDomains()
 	for _, domain := range domains {
@@ -49,98 +61,175 @@ func Run(httpPort uint16, socksPort uint16, uri string) error {
 	}
 	uri += "id=" + uuid.NewV4().String()
 
-	transport, err := comm.NewWebSocketTransport(uri)
+	transport, err := comm.NewWebSocketTransport(uri, config.GetBatching(), config.GetScheduling())
 	if err != nil {
 		panic(err)
 	}
 	this.transport = transport
 
-	tcpListener, err := net.Listen("tcp", fmt.Sprintf(":%d", socksPort))
-	if err != nil {
-		panic(err)
+	fakeIpRange := config.GetFakeIpRange()
+	if fakeIpRange != nil {
+		this.fakeIPs = NewFakeIPPool(fakeIpRange)
+		log.Println("Fake IP mode is enabled in", fakeIpRange)
 	}
-	this.tcpListener = tcpListener
 
-	log.Println("SOCKS server is listening on port", socksPort)
-	cfg := &socks.SOCKSConf{
+	// rule lists are downloaded through the proxy
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Dial: this.dial,
+		},
+	}
+	this.ruleSet = NewRuleSet(config.GetRuleSources(), config.GetRuleCacheDir(), httpClient)
+	this.ruleSet.Start(5 * time.Second)
+
+	this.forwarder = NewForwarder(this, config.GetVia())
+	this.socksConf = &socks.SOCKSConf{
 		Dial:        this.dial,
 		HandleError: this.handleError,
+		Associate:   this.associate,
+		Bind:        this.bind,
+		StatusOf:    socks5StatusOf,
+	}
+	if this.sniffing {
+		this.socksConf.Sniff = this.sniff
+		this.socksConf.DialAs = this.dialAs
+		log.Println("Sniffing is enabled for the requests to an IP")
+	}
+	if len(this.users) > 0 {
+		// SOCKS4 has no authentication, so it is rejected
+		this.socksConf.Auth = this.authenticate
+		log.Println("Authentication is required for", len(this.users), "users")
 	}
-	go (func() {
-		socks.Serve(tcpListener, cfg)
-	})()
-
-	time.AfterFunc(5*time.Second, func() { this.loadGfwList() })
-
-	log.Println("SmartConnectTimeout =", config.GetSmartConnectTimeout())
-
 	server := &http.Server{
-		Addr: fmt.Sprintf(":%d", httpPort),
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !this.authenticateHTTP(w, r) {
+				return
+			}
+			r.Header.Del("Proxy-Authorization")
 			if r.Method == http.MethodConnect {
 				this.handleTunneling(w, r)
 			} else {
-				this.handleHTTP(w, r)
+				this.forwarder.ServeHTTP(w, r)
 			}
 		}),
 		// Disable HTTP/2.
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
-	log.Println("HTTP server is listening on port", httpPort)
-	log.Fatal(server.ListenAndServe())
+	serverErrors := make(chan error, 2)
+
+	if socksPort > 0 {
+		socksListener := this.listen(bindAddress, socksPort)
+		log.Println("SOCKS server is listening on", socksListener.Addr())
+		go (func() {
+			socks.Serve(socksListener, this.socksConf)
+		})()
+	}
+
+	if mixedPort > 0 {
+		mixedListener := this.listen(bindAddress, mixedPort)
+		httpListener := newConnListener(mixedListener.Addr())
+		log.Println("SOCKS and HTTP server is listening on", mixedListener.Addr())
+		go this.serveMixed(mixedListener, httpListener)
+		go (func() {
+			serverErrors <- server.Serve(httpListener)
+		})()
+	}
+
+	for _, forward := range config.GetForwards() {
+		err = NewPortForward(this, forward).Start()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	reverseForwards := config.GetReverseForwards()
+	if len(reverseForwards) > 0 {
+		channel := make(chan dto.Message, 10) // messages of unknown connections
+		transport.RegisterChannel(0, channel)
+		go this.dispatchReverseConnections(channel)
+		for _, forward := range reverseForwards {
+			NewReverseForward(this, forward).Start()
+		}
+	}
+
+	redirPort := config.GetRedirPort()
+	if redirPort > 0 {
+		tproxy := config.GetRedirMode() == config.RedirModeTProxy
+		redirListener, err := listenRedir(net.JoinHostPort(bindAddress, strconv.Itoa(int(redirPort))), tproxy)
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Transparent proxy is listening on", redirListener.Addr(), "in", config.GetRedirMode(), "mode")
+		go this.serveRedir(newAllowedListener(redirListener, this.allowedSources), tproxy)
+	}
+
+	dnsPort := config.GetDnsPort()
+	if dnsPort > 0 {
+		this.dnsServer = NewDnsServer(this, config.GetDnsServer(), config.GetRemoteDnsServer())
+		this.dnsServer.Start(bindAddress, dnsPort)
+	}
+
+	log.Println("SmartConnectTimeout =", config.GetSmartConnectTimeout())
+
+	if httpPort > 0 {
+		httpListener := this.listen(bindAddress, httpPort)
+		log.Println("HTTP server is listening on", httpListener.Addr())
+		go (func() {
+			serverErrors <- server.Serve(httpListener)
+		})()
+	}
+	log.Fatal(<-serverErrors)
 
 	return nil
 }
 
+// listen on the port, only accepting connections from the allowed sources
+func (this *ProxyClient) listen(bindAddress string, port uint16) net.Listener {
+	listener, err := net.Listen("tcp", net.JoinHostPort(bindAddress, strconv.Itoa(int(port))))
+	if err != nil {
+		panic(err)
+	}
+	return newAllowedListener(listener, this.allowedSources)
+}
+
 func (this *ProxyClient) handleError(err error) {
+	var dtoErr *dto.Error
+	if errors.As(err, &dtoErr) {
+		log.Println(dtoErr.Code, ":", err)
+		return
+	}
 	log.Println(err)
 }
 
 func (this *ProxyClient) dial(network, address string) (net.Conn, error) {
+	return this.dialAs(network, address, "")
+}
+
+// dialAs connects to the address for the name sniffed from the connection, empty if none.
+// The name decides the route and is what the exit server connects to,
+// but a direct connection goes to the address the application chose rather than resolving the name again
+func (this *ProxyClient) dialAs(network, address string, name string) (net.Conn, error) {
 
 	if network != "tcp" {
 		return nil, errors.New(fmt.Sprintf("Unsupported protocol : %v", network))
 	}
-
-	idx := strings.LastIndex(address, ":")
-	if idx < 1 {
-		return nil, errors.New(fmt.Sprintf("Invalid address : %v", network))
-	}
-	host := address[:idx]
-	port, err := strconv.Atoi(address[idx+1:])
+	host, port, err := this.parseAddress(address)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Invalid address : %v", network))
+		return nil, err
 	}
-
-	// check host if it should not be proxied
-	needProxy := (func() bool {
-		this.mutex.RLock()
-		defer this.mutex.RUnlock()
-
-		segs := strings.Split(host, ".")
-		if len(segs) > 1 {
-			domain := strings.ToLower(segs[len(segs)-1])
-			for i := 1; i < len(segs); i++ {
-				domain = strings.ToLower(segs[len(segs)-1-i]) + "." + domain
-				if this.inaccessibleHostMap[domain] {
-					return true
-				}
-			}
-		}
-
-		return false
-	})()
-	if !needProxy {
-		needProxy = this.isBlockedByGFW(host)
+	tunnelHost := host
+	if len(name) > 0 {
+		tunnelHost = name
 	}
 
-	if !needProxy {
+	// check host if it should not be proxied
+	if !this.needProxy(tunnelHost) {
 		smartConnectTimeout := config.GetSmartConnectTimeout()
 		timeout := time.Duration(smartConnectTimeout) * time.Second
 		if timeout <= 0 {
 			timeout = 20 * time.Second
 		}
-		conn, err := net.DialTimeout("tcp", address, timeout)
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
 		if err != nil {
 			if isPrivateIP(host) || smartConnectTimeout <= 0 {
 				return nil, err
@@ -149,7 +238,37 @@ func (this *ProxyClient) dial(network, address string) (net.Conn, error) {
 			return conn, nil
 		}
 	}
+	return this.dialThroughTunnel(tunnelHost, port)
+}
+
+// parseAddress splits "host:port", and translates the fake address back to the name it was handed out for
+func (this *ProxyClient) parseAddress(address string) (string, int, error) {
+	idx := strings.LastIndex(address, ":")
+	if idx < 1 {
+		return "", 0, errors.New(fmt.Sprintf("Invalid address : %v", address))
+	}
+	host := strings.Trim(address[:idx], "[]")
+	port, err := strconv.Atoi(address[idx+1:])
+	if err != nil {
+		return "", 0, errors.New(fmt.Sprintf("Invalid address : %v", address))
+	}
+
+	if this.fakeIPs != nil && this.fakeIPs.Contains(host) {
+		domain := this.fakeIPs.Lookup(host)
+		if len(domain) == 0 {
+			return "", 0, errors.New(fmt.Sprintf("Unknown fake address : %v", host))
+		}
+		host = domain
+	}
+	return host, port, nil
+}
+
+func (this *ProxyClient) dialThroughTunnel(host string, port int) (net.Conn, error) {
 	proxyConn, err := NewProxyConnection(host, uint16(port), this.transport)
+	for retries := 0; isNoServerAvailable(err) && retries < noServerRetries; retries++ {
+		time.Sleep(noServerRetryDelay)
+		proxyConn, err = NewProxyConnection(host, uint16(port), this.transport)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -159,6 +278,57 @@ func (this *ProxyClient) dial(network, address string) (net.Conn, error) {
 	return proxyConn, nil
 }
 
+// associate opens a UDP association on the exit server, all datagrams go through the tunnel
+func (this *ProxyClient) associate() (socks.Association, error) {
+	association, err := NewProxyAssociation(this.transport)
+	if err != nil {
+		return nil, err
+	}
+	return association, nil
+}
+
+// bind listens on the exit server for the peer at address
+func (this *ProxyClient) bind(address string) (socks.Binding, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, err
+	}
+	binding, err := NewProxyBinding(host, uint16(port), this.transport)
+	if err != nil {
+		return nil, err
+	}
+	return binding, nil
+}
+
+// needProxy tells if the host is known to be inaccessible directly
+func (this *ProxyClient) needProxy(host string) bool {
+	inaccessible := (func() bool {
+		this.mutex.RLock()
+		defer this.mutex.RUnlock()
+
+		segs := strings.Split(host, ".")
+		if len(segs) > 1 {
+			domain := strings.ToLower(segs[len(segs)-1])
+			for i := 1; i < len(segs); i++ {
+				domain = strings.ToLower(segs[len(segs)-1-i]) + "." + domain
+				if this.inaccessibleHostMap[domain] {
+					return true
+				}
+			}
+		}
+
+		return false
+	})()
+	if inaccessible {
+		return true
+	}
+	return this.isBlockedByGFW(host)
+}
+
 func isPrivateIP(ip string) bool {
 	if ip == "127.0.0.1" || ip == "::1" {
 		return true
@@ -175,9 +345,14 @@ func isPrivateIP(ip string) bool {
 }
 
 func (this *ProxyClient) handleTunneling(w http.ResponseWriter, r *http.Request) {
+	if this.sniffing && sniffable(r.Host) {
+		this.handleTunnelingWithSniffing(w, r)
+		return
+	}
+
 	dest_conn, err := this.dial("tcp", r.Host)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		http.Error(w, err.Error(), httpStatusOf(err))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -194,21 +369,52 @@ func (this *ProxyClient) handleTunneling(w http.ResponseWriter, r *http.Request)
 	go this.transfer(client_conn, dest_conn)
 }
 
-func (this *ProxyClient) handleHTTP(w http.ResponseWriter, req *http.Request) {
-
-	httpTransport := &http.Transport{
-		Dial: this.dial,
+// handleTunnelingWithSniffing may reply the CONNECT request before dialing,
+// so that the application sends the first bytes which may tell the name of the server
+func (this *ProxyClient) handleTunnelingWithSniffing(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
 	}
-
-	resp, err := httpTransport.RoundTrip(req)
+	client_conn, _, err := hijacker.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
-	defer resp.Body.Close()
-	this.copyHeader(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	replied := false
+	reply := func() {
+		replied = true
+		client_conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}
+
+	data, name := this.sniff(client_conn, r.Host, reply)
+	dest_conn, err := this.dialAs("tcp", r.Host, name)
+	if err != nil {
+		if replied {
+			// the application was told the connection is established, it only sees it closed
+			log.Println("Unable to dial", r.Host, "after replying early, closed instead of replying", httpStatusOf(err), ",", err)
+		} else {
+			log.Println("Unable to dial", r.Host, ",", err)
+			status := httpStatusOf(err)
+			client_conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nConnection: close\r\n\r\n", status, http.StatusText(status))))
+		}
+		client_conn.Close()
+		return
+	}
+	if !replied {
+		reply()
+	}
+	if len(data) > 0 {
+		_, err = dest_conn.Write(data)
+		if err != nil {
+			dest_conn.Close()
+			client_conn.Close()
+			return
+		}
+	}
+	go this.transfer(dest_conn, client_conn)
+	go this.transfer(client_conn, dest_conn)
 }
 
 func (this *ProxyClient) transfer(destination io.WriteCloser, source io.ReadCloser) {
@@ -225,46 +431,6 @@ func (this *ProxyClient) copyHeader(dst, src http.Header) {
 	}
 }
 
-func (this *ProxyClient) loadGfwList() {
-
-	if len(config.GetGfwListUrl()) == 0 {
-		return
-	}
-
-	httpTransport := &http.Transport{
-		Dial: this.dial,
-	}
-	httpClient := &http.Client{Transport: httpTransport}
-
-	// Get the data
-	resp, err := httpClient.Get(config.GetGfwListUrl())
-	if err != nil {
-		time.AfterFunc(5*time.Second, func() { this.loadGfwList() })
-		log.Println(err)
-		return
-	}
-	defer resp.Body.Close()
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		time.AfterFunc(5*time.Second, func() { this.loadGfwList() })
-		log.Println(err)
-		return
-	}
-	base64Text := string(bodyBytes)
-
-	this.gfwList, err = ParseRawGFWList(string(base64Text))
-	if err != nil {
-		time.AfterFunc(5*time.Second, func() { this.loadGfwList() })
-		log.Println(err)
-		return
-	}
-	log.Println("Loaded GFW list from", config.GetGfwListUrl())
-
-}
-
 func (this *ProxyClient) isBlockedByGFW(host string) bool {
-	if this.gfwList != nil {
-		return this.gfwList.IsBlocked(host)
-	}
-	return false
+	return this.ruleSet.IsBlocked(host)
 }
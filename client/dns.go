@@ -0,0 +1,325 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../dto"
+
+	"github.com/miekg/dns"
+)
+
+// DnsServer answers the queries of local applications.
+// Names which should be proxied are resolved by the exit server through the tunnel,
+// so that the answers are not poisoned by the local network
+type DnsServer struct {
+	client       *ProxyClient
+	localServer  string // empty if there is no nameserver to resolve directly
+	remoteServer string
+	cache        *dnsCache
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	created time.Time
+	expires time.Time
+}
+
+type dnsCache struct {
+	set   map[string]*dnsCacheEntry
+	mutex sync.RWMutex
+}
+
+const (
+	dnsTimeout         = 10 * time.Second
+	dnsMaxCacheTTL     = 3600 // seconds
+	dnsNegativeTTL     = 60   // seconds, used when there is no SOA record
+	dnsCacheSweepDelay = time.Minute
+	fakeIPTTL          = 60 // seconds
+)
+
+func NewDnsServer(client *ProxyClient, localServer string, remoteServer string) *DnsServer {
+	this := &DnsServer{
+		client:       client,
+		localServer:  localServer,
+		remoteServer: remoteServer,
+		cache:        newDnsCache(),
+	}
+
+	if len(this.localServer) == 0 {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err == nil && len(conf.Servers) > 0 {
+			this.localServer = net.JoinHostPort(conf.Servers[0], conf.Port)
+		} else {
+			log.Println("No local nameserver is found, all DNS queries will be sent through the tunnel")
+		}
+	}
+	return this
+}
+
+// Start listens on both UDP and TCP
+func (this *DnsServer) Start(bindAddress string, port uint16) {
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{
+			Addr:    net.JoinHostPort(bindAddress, strconv.Itoa(int(port))),
+			Net:     network,
+			Handler: this,
+		}
+		go (func() {
+			err := server.ListenAndServe()
+			if err != nil {
+				log.Println("DNS server on", server.Net, "exited :", err)
+			}
+		})()
+	}
+	log.Println("DNS server is listening on port", port)
+}
+
+func (this *DnsServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if !isAllowedSource(w.RemoteAddr(), this.client.allowedSources) {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(resp)
+		return
+	}
+	if len(req.Question) != 1 {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(resp)
+		return
+	}
+
+	start := time.Now()
+	question := req.Question[0]
+	resp, via, err := this.resolve(req)
+	if err != nil {
+		log.Println("DNS", question.Name, dns.TypeToString[question.Qtype], "failed", via, ":", err)
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	} else {
+		log.Println("DNS", question.Name, dns.TypeToString[question.Qtype], "resolved", via, "with",
+			dns.RcodeToString[resp.Rcode], len(resp.Answer), "answers in", time.Since(start))
+	}
+	w.WriteMsg(resp)
+}
+
+func (this *DnsServer) resolve(req *dns.Msg) (*dns.Msg, string, error) {
+	question := req.Question[0]
+	host := strings.ToLower(strings.TrimSuffix(question.Name, "."))
+
+	// in fake-IP mode, names to be proxied are never resolved locally.
+	// dial() translates the fake address back so that the exit server connects to the name
+	fakeIPs := this.client.fakeIPs
+	if fakeIPs != nil && question.Qclass == dns.ClassINET &&
+		(question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA) &&
+		this.client.needProxy(host) {
+		return this.fakeAnswer(req, fakeIPs), "with fake IP", nil
+	}
+
+	key := dnsCacheKey(question)
+	if cached := this.cache.get(key); cached != nil {
+		cached.Id = req.Id
+		return cached, "from cache", nil
+	}
+
+	var resp *dns.Msg
+	var err error
+	var via string
+	if len(this.localServer) == 0 || this.client.needProxy(host) {
+		via = "through tunnel"
+		resp, err = this.exchangeThroughTunnel(req)
+	} else {
+		via = "directly"
+		resp, err = this.exchangeDirectly(req)
+	}
+	if err != nil {
+		return nil, via, err
+	}
+
+	this.cache.add(key, resp)
+	resp.Id = req.Id
+	return resp, via, nil
+}
+
+// fakeAnswer replies an address from the fake range to A queries, and no address to AAAA queries
+// so that applications always connect through IPv4
+func (this *DnsServer) fakeAnswer(req *dns.Msg, fakeIPs *FakeIPPool) *dns.Msg {
+	question := req.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	if question.Qtype == dns.TypeA {
+		record := &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    fakeIPTTL,
+			},
+			A: fakeIPs.Allocate(question.Name),
+		}
+		resp.Answer = append(resp.Answer, record)
+	}
+	return resp
+}
+
+func (this *DnsServer) exchangeDirectly(req *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{
+		Net:     "udp",
+		Timeout: dnsTimeout,
+	}
+	resp, _, err := client.Exchange(req, this.localServer)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.Exchange(req, this.localServer)
+	}
+	return resp, err
+}
+
+// exchangeThroughTunnel lets the exit server send the query to the remote nameserver
+func (this *DnsServer) exchangeThroughTunnel(req *dns.Msg) (*dns.Msg, error) {
+	data, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	host, portText, err := net.SplitHostPort(this.remoteServer)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := this.client.transport
+	connectionID := newConnectionID()
+	channel := make(chan dto.Message, 1)
+	transport.RegisterChannel(connectionID, channel)
+	defer transport.UnregisterChannel(connectionID, channel)
+
+	payload := &dto.Payload{
+		Address: host,
+		Port:    int32(port),
+		Data:    data,
+	}
+	err = transport.Write(dto.Type_DNS_QUERY, connectionID, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg, more := <-channel:
+		if !more {
+			return nil, errors.New("The query is cancelled")
+		}
+		if msg.Header.Type == dto.Type_TCP_CONNECTION_FAILED {
+			return nil, dto.ErrorOf(msg.Payload, "Unspecific error on DNS query")
+		} else if msg.Header.Type != dto.Type_DNS_RESPONSE {
+			return nil, errors.New(fmt.Sprintf("Unknown response type %v", msg.Header.Type))
+		}
+		resp := new(dns.Msg)
+		err = resp.Unpack(msg.Payload.GetData())
+		msg.Release()
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+
+	case <-time.After(dnsTimeout):
+		return nil, dto.NewError(dto.ErrorCode_TIMEOUT, fmt.Sprintf("No DNS response within %v", dnsTimeout))
+	}
+}
+
+func dnsCacheKey(question dns.Question) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(question.Name), question.Qtype, question.Qclass)
+}
+
+func newDnsCache() *dnsCache {
+	instance := &dnsCache{}
+	instance.set = make(map[string]*dnsCacheEntry)
+	instance.mutex = sync.RWMutex{}
+	time.AfterFunc(dnsCacheSweepDelay, instance.sweep)
+	return instance
+}
+
+// add caches the response for the minimum TTL of its records
+func (this *dnsCache) add(key string, msg *dns.Msg) {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return
+	}
+
+	ttl := uint32(dnsMaxCacheTTL)
+	if len(msg.Answer) == 0 {
+		ttl = dnsNegativeTTL
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+		}
+	}
+	for _, rr := range msg.Answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.set[key] = &dnsCacheEntry{
+		msg:     msg.Copy(),
+		created: now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// get returns a copy of the cached response whose TTLs are reduced by the time elapsed
+func (this *dnsCache) get(key string) *dns.Msg {
+	this.mutex.RLock()
+	entry := this.set[key]
+	this.mutex.RUnlock()
+
+	now := time.Now()
+	if entry == nil || now.After(entry.expires) {
+		return nil
+	}
+
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.created) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if header.Ttl > elapsed {
+				header.Ttl -= elapsed
+			} else {
+				header.Ttl = 0
+			}
+		}
+	}
+	return msg
+}
+
+func (this *dnsCache) sweep() {
+	defer time.AfterFunc(dnsCacheSweepDelay, this.sweep)
+
+	now := time.Now()
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for key, entry := range this.set {
+		if now.After(entry.expires) {
+			delete(this.set, key)
+		}
+	}
+}
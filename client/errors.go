@@ -0,0 +1,55 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"../dto"
+	"../socks"
+)
+
+const (
+	// a request rejected for lack of servers is retried, as a server may connect to the broker shortly
+	noServerRetries    = 3
+	noServerRetryDelay = time.Second
+)
+
+func isNoServerAvailable(err error) bool {
+	var dtoErr *dto.Error
+	return errors.As(err, &dtoErr) && dtoErr.Code == dto.ErrorCode_NO_SERVER_AVAILABLE
+}
+
+// httpStatusOf maps the error of dialing to the status replied to HTTP clients
+func httpStatusOf(err error) int {
+	switch dto.ErrorCodeOf(err) {
+	case dto.ErrorCode_NOT_ALLOWED:
+		return http.StatusForbidden
+	case dto.ErrorCode_TIMEOUT:
+		return http.StatusGatewayTimeout
+	case dto.ErrorCode_CONNECTION_REFUSED,
+		dto.ErrorCode_NAME_NOT_RESOLVED,
+		dto.ErrorCode_HOST_UNREACHABLE,
+		dto.ErrorCode_NETWORK_UNREACHABLE:
+		return http.StatusBadGateway
+	}
+	return http.StatusServiceUnavailable
+}
+
+// socks5Statuses maps the code of a failure to the SOCKS5 reply status, the others are general failures
+var socks5Statuses = map[dto.ErrorCode]byte{
+	dto.ErrorCode_NOT_ALLOWED:         socks.Socks5StatusNotAllowed,
+	dto.ErrorCode_NETWORK_UNREACHABLE: socks.Socks5StatusNetworkUnreachable,
+	dto.ErrorCode_HOST_UNREACHABLE:    socks.Socks5StatusHostUnreachable,
+	dto.ErrorCode_NAME_NOT_RESOLVED:   socks.Socks5StatusHostUnreachable,
+	dto.ErrorCode_CONNECTION_REFUSED:  socks.Socks5StatusConnectionRefused,
+	dto.ErrorCode_TIMEOUT:             socks.Socks5StatusTTLExpired,
+}
+
+// socks5StatusOf maps the error of dialing to the status replied to SOCKS5 clients
+func socks5StatusOf(err error) byte {
+	if status, ok := socks5Statuses[dto.ErrorCodeOf(err)]; ok {
+		return status
+	}
+	return socks.Socks5StatusGeneral
+}
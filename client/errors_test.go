@@ -0,0 +1,32 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"../dto"
+	"../socks"
+)
+
+func TestSocks5StatusOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status byte
+	}{
+		{"reported", dto.NewError(dto.ErrorCode_NOT_ALLOWED, "denied"), socks.Socks5StatusNotAllowed},
+		{"name not resolved", dto.NewError(dto.ErrorCode_NAME_NOT_RESOLVED, "no such host"), socks.Socks5StatusHostUnreachable},
+		{"timeout", dto.NewError(dto.ErrorCode_TIMEOUT, "no reply"), socks.Socks5StatusTTLExpired},
+		{"busy", dto.NewError(dto.ErrorCode_SERVER_BUSY, "busy"), socks.Socks5StatusGeneral},
+		{"refused", syscall.ECONNREFUSED, socks.Socks5StatusConnectionRefused},
+		{"wrapped", fmt.Errorf("upstream : %w", syscall.ENETUNREACH), socks.Socks5StatusNetworkUnreachable},
+		{"unknown", errors.New("host is unreachable"), socks.Socks5StatusGeneral},
+	}
+	for _, test := range tests {
+		if status := socks5StatusOf(test.err); status != test.status {
+			t.Errorf("%v : got %v, want %v", test.name, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+)
+
+// FakeIPPool hands out addresses from a reserved range and remembers which domain each one stands for.
+// When the range is exhausted, addresses are recycled from the oldest allocation
+type FakeIPPool struct {
+	network    *net.IPNet
+	base       uint32
+	size       uint32
+	next       uint32
+	ipToDomain map[uint32]string
+	domainToIP map[string]uint32
+	mutex      sync.Mutex
+}
+
+func NewFakeIPPool(network *net.IPNet) *FakeIPPool {
+	instance := &FakeIPPool{
+		network: network,
+	}
+	ones, bits := network.Mask.Size()
+	instance.base = binary.BigEndian.Uint32(network.IP.To4())
+	instance.size = uint32(1) << uint(bits-ones)
+	instance.next = 1 // skip the network address
+	instance.ipToDomain = make(map[uint32]string)
+	instance.domainToIP = make(map[string]uint32)
+	instance.mutex = sync.Mutex{}
+	return instance
+}
+
+// Allocate returns the fake address of the domain, a new one is assigned if there is none
+func (this *FakeIPPool) Allocate(domain string) net.IP {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	offset, ok := this.domainToIP[domain]
+	if !ok {
+		offset = this.next
+		this.next++
+		if this.next >= this.size-1 { // skip the broadcast address
+			this.next = 1
+		}
+
+		// recycle the address if it was given to another domain
+		if original, ok := this.ipToDomain[offset]; ok {
+			delete(this.domainToIP, original)
+		}
+		this.ipToDomain[offset] = domain
+		this.domainToIP[domain] = offset
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, this.base+offset)
+	return ip
+}
+
+// Contains tells if the host is an address in the fake range
+func (this *FakeIPPool) Contains(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && this.network.Contains(ip)
+}
+
+// Lookup returns the domain of the fake address, or an empty string if it is unknown
+func (this *FakeIPPool) Lookup(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil || !this.network.Contains(ip) {
+		return ""
+	}
+	offset := binary.BigEndian.Uint32(ip.To4()) - this.base
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.ipToDomain[offset]
+}
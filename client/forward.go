@@ -0,0 +1,250 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// headers which only make sense for a single connection, RFC 7230 section 6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, but sent by many clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Forwarder proxies plain HTTP requests. Requests to hosts known to be inaccessible go through the tunnel,
+// others are connected smartly. Each route has its own transport so that connections are reused
+type Forwarder struct {
+	client          *ProxyClient
+	smartTransport  *http.Transport
+	tunnelTransport *http.Transport
+	via             string // pseudonym added to `Via`, empty if not added
+}
+
+func NewForwarder(client *ProxyClient, via string) *Forwarder {
+	this := &Forwarder{
+		client: client,
+		via:    via,
+	}
+	this.smartTransport = this.newTransport(client.dial)
+	this.tunnelTransport = this.newTransport(func(network, address string) (net.Conn, error) {
+		host, port, err := client.parseAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		return client.dialThroughTunnel(host, port)
+	})
+	return this
+}
+
+func (this *Forwarder) newTransport(dial func(network, address string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		Dial:                dial,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+		// the response is relayed as it is, without being decompressed
+		DisableCompression: true,
+	}
+}
+
+// route picks the transport by the host of the request
+func (this *Forwarder) route(req *http.Request) *http.Transport {
+	host, _, err := this.client.parseAddress(canonicalAddress(req))
+	if err == nil && this.client.needProxy(host) {
+		return this.tunnelTransport
+	}
+	return this.smartTransport
+}
+
+func (this *Forwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !req.URL.IsAbs() {
+		http.Error(w, "This is a proxy server, the request URI must be absolute", http.StatusBadRequest)
+		return
+	}
+
+	outReq := req.WithContext(req.Context())
+	outReq.RequestURI = ""
+	outReq.Close = false
+	outReq.Header = make(http.Header)
+	this.client.copyHeader(outReq.Header, req.Header)
+	upgrade := upgradeType(req.Header)
+	removeHopByHopHeaders(outReq.Header)
+	if len(upgrade) > 0 {
+		// the transport hands over the connection once the server switches protocols
+		outReq.Header.Set("Connection", "Upgrade")
+		outReq.Header.Set("Upgrade", upgrade)
+	}
+	this.addVia(outReq.Header, req.ProtoMajor, req.ProtoMinor)
+	if _, ok := outReq.Header["User-Agent"]; !ok {
+		outReq.Header.Set("User-Agent", "") // not to add the default one
+	}
+	if req.ContentLength == 0 {
+		outReq.Body = nil
+	}
+
+	resp, err := this.route(req).RoundTrip(outReq)
+	if err != nil {
+		log.Println("Unable to forward", req.Method, req.URL, ",", err)
+		http.Error(w, err.Error(), httpStatusOf(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		this.switchProtocols(w, resp)
+		return
+	}
+
+	removeHopByHopHeaders(resp.Header)
+	this.addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	this.client.copyHeader(w.Header(), resp.Header)
+	if _, ok := resp.Header["Content-Type"]; !ok {
+		w.Header()["Content-Type"] = nil // not to sniff the content type
+	}
+	if len(resp.Trailer) > 0 {
+		for name := range resp.Trailer {
+			w.Header().Add("Trailer", name)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// responses of unknown length are flushed as soon as data arrives, e.g. server-sent events
+	if resp.ContentLength < 0 {
+		err = copyWithFlush(w, resp.Body)
+	} else {
+		_, err = io.Copy(w, resp.Body)
+	}
+	if err != nil {
+		log.Println("Unable to relay the response of", req.Method, req.URL, ",", err)
+		return
+	}
+	for name, values := range resp.Trailer {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+}
+
+// switchProtocols hijacks the connection of the application, and relays both directions after the 101 response
+func (this *Forwarder) switchProtocols(w http.ResponseWriter, resp *http.Response) {
+	remoteConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(w, "The upgraded connection is not writable", http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	localConn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	this.addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	fmt.Fprintf(buffer, "HTTP/1.1 %v\r\n", resp.Status)
+	resp.Header.Write(buffer)
+	buffer.WriteString("\r\n")
+	if err = buffer.Flush(); err != nil {
+		localConn.Close()
+		return
+	}
+
+	// bytes the application sent after the request may already be buffered
+	if n := buffer.Reader.Buffered(); n > 0 {
+		data, _ := buffer.Reader.Peek(n)
+		if _, err = remoteConn.Write(data); err != nil {
+			localConn.Close()
+			return
+		}
+	}
+	go this.client.transfer(remoteConn, localConn)
+	this.client.transfer(localConn, remoteConn)
+}
+
+func (this *Forwarder) addVia(header http.Header, major, minor int) {
+	if len(this.via) == 0 {
+		return
+	}
+	via := fmt.Sprintf("%d.%d %v", major, minor, this.via)
+	if prior := header.Get("Via"); len(prior) > 0 {
+		via = prior + ", " + via
+	}
+	header.Set("Via", via)
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, including those listed in `Connection`
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// upgradeType returns the protocol the request asks to upgrade to, or an empty string
+func upgradeType(header http.Header) string {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "Upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// canonicalAddress returns "host:port" of the request URL
+func canonicalAddress(req *http.Request) string {
+	port := req.URL.Port()
+	if len(port) == 0 {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port)
+}
+
+// copyWithFlush copies the body, flushing each chunk to the application
+func copyWithFlush(w http.ResponseWriter, body io.Reader) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		_, err := io.Copy(w, body)
+		return err
+	}
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buffer)
+		if n > 0 {
+			if _, werr := w.Write(buffer[:n]); werr != nil {
+				return werr
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -90,18 +90,24 @@ type GFWList struct {
 }
 
 func (gfw *GFWList) IsBlocked(host string) bool {
+	_, blocked := gfw.Match(host)
+	return blocked
+}
+
+// Match tells if any rule in the list matches the host, and if so, whether the host is blocked
+func (gfw *GFWList) Match(host string) (matched bool, blocked bool) {
 	for _, rule := range gfw.white_list {
 		if rule.match(host) {
-			return false
+			return true, false
 		}
 	}
 	for _, rule := range gfw.black_list {
 		if rule.match(host) {
 			//log.Printf("matched for :%v for %v\n", req.URL, rule)
-			return true
+			return true, true
 		}
 	}
-	return false
+	return false, false
 }
 
 func Parse(rules string) (*GFWList, error) {
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"../socks"
+)
+
+// the first byte must arrive within this duration, or the connection is dropped
+const mixedPeekTimeout = 30 * time.Second
+
+// peekedConn is a connection whose first bytes have been peeked but not consumed
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (this *peekedConn) Read(b []byte) (int, error) {
+	return this.reader.Read(b)
+}
+
+// connListener is a synthetic listener accepting connections handed over by the mixed port
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (this *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-this.conns:
+		return conn, nil
+	case <-this.closed:
+		return nil, errors.New("The listener is closed")
+	}
+}
+
+func (this *connListener) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+	return nil
+}
+
+func (this *connListener) Addr() net.Addr {
+	return this.addr
+}
+
+// handOver queues the connection for Accept(), or closes it if the listener is closed
+func (this *connListener) handOver(conn net.Conn) {
+	select {
+	case this.conns <- conn:
+	case <-this.closed:
+		conn.Close()
+	}
+}
+
+// serveMixed tells SOCKS from HTTP by the first byte, SOCKS4 and SOCKS5 start with their versions
+func (this *ProxyClient) serveMixed(listener net.Listener, httpListener *connListener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			this.handleError(err)
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			httpListener.Close()
+			return
+		}
+		go this.handleMixed(conn, httpListener)
+	}
+}
+
+func (this *ProxyClient) handleMixed(conn net.Conn, httpListener *connListener) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(mixedPeekTimeout))
+	header, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	peeked := &peekedConn{
+		Conn:   conn,
+		reader: reader,
+	}
+	if socks.IsSOCKSVersion(header[0]) {
+		socks.ServeConn(peeked, this.socksConf)
+	} else {
+		httpListener.handOver(peeked)
+	}
+}
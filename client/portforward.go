@@ -0,0 +1,77 @@
+package client
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"../config"
+)
+
+// PortForward relays the connections accepted on a local address to a fixed remote address.
+// Connections always go through the tunnel, the rules are not consulted
+type PortForward struct {
+	client         *ProxyClient
+	listen         string
+	host           string
+	port           uint16
+	allowedSources []*net.IPNet
+	connectTimeout time.Duration
+}
+
+func NewPortForward(client *ProxyClient, forward config.PortForward) *PortForward {
+	host, portText, _ := net.SplitHostPort(forward.Remote)
+	port, err := strconv.Atoi(portText)
+	if err != nil || port <= 0 || port > 65535 {
+		panic("`remote` of `forwards` has an invalid port, please check your configuration file")
+	}
+	instance := &PortForward{
+		client:         client,
+		listen:         forward.Listen,
+		host:           host,
+		port:           uint16(port),
+		allowedSources: forward.GetAllowedSources(),
+		connectTimeout: forward.GetConnectTimeout(),
+	}
+	if instance.allowedSources == nil {
+		instance.allowedSources = client.allowedSources
+	}
+	return instance
+}
+
+func (this *PortForward) Start() error {
+	listener, err := net.Listen("tcp", this.listen)
+	if err != nil {
+		return err
+	}
+	log.Println("Forwarding", listener.Addr(), "to", net.JoinHostPort(this.host, strconv.Itoa(int(this.port))))
+	go this.serve(newAllowedListener(listener, this.allowedSources))
+	return nil
+}
+
+func (this *PortForward) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			this.client.handleError(err)
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go this.handle(conn)
+	}
+}
+
+func (this *PortForward) handle(conn net.Conn) {
+	remoteConn, err := NewProxyConnectionWithTimeout(this.host, this.port, this.client.transport, this.connectTimeout)
+	if err != nil {
+		log.Println("Unable to forward", conn.RemoteAddr(), "to", net.JoinHostPort(this.host, strconv.Itoa(int(this.port))), ",", err)
+		conn.Close()
+		return
+	}
+	go this.client.transfer(remoteConn, conn)
+	go this.client.transfer(conn, remoteConn)
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"../comm"
+	"../dto"
+)
+
+// ProxyAssociation relays datagrams through a UDP socket opened on the exit server
+type ProxyAssociation struct {
+	transport    comm.Transport
+	connectionId int64
+	channel      chan dto.Message
+	closeOnce    sync.Once
+}
+
+func NewProxyAssociation(transport comm.Transport) (*ProxyAssociation, error) {
+	instance := &ProxyAssociation{
+		transport:    transport,
+		connectionId: newConnectionID(),
+	}
+
+	// datagrams may arrive in bursts
+	instance.channel = make(chan dto.Message, 100)
+	transport.RegisterChannel(instance.connectionId, instance.channel)
+
+	err := transport.Write(dto.Type_UDP_ASSOCIATE, instance.connectionId, nil)
+	if err != nil {
+		transport.UnregisterChannel(instance.connectionId, instance.channel)
+		return nil, err
+	}
+
+	select {
+	case msg := <-instance.channel:
+		if msg.Header.Type == dto.Type_TCP_CONNECTION_FAILED {
+			transport.UnregisterChannel(instance.connectionId, instance.channel)
+			return nil, dto.ErrorOf(msg.Payload, "Unspecific error on association")
+		} else if msg.Header.Type != dto.Type_TCP_CONNECTION_ESTABLISHED {
+			transport.UnregisterChannel(instance.connectionId, instance.channel)
+			return nil, errors.New(fmt.Sprintf("Unknown response type %v", msg.Header.Type))
+		}
+
+	case <-time.After(45 * time.Second):
+		transport.UnregisterChannel(instance.connectionId, instance.channel)
+		return nil, dto.NewError(dto.ErrorCode_TIMEOUT, "Association cannot be established within 45 seconds")
+	}
+
+	return instance, nil
+}
+
+func (this *ProxyAssociation) WriteTo(data []byte, address string) error {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return err
+	}
+	payload := &dto.Payload{
+		Address: host,
+		Port:    int32(port),
+		Data:    data,
+	}
+	return this.transport.Write(dto.Type_UDP_DATAGRAM, this.connectionId, payload)
+}
+
+func (this *ProxyAssociation) ReadFrom() ([]byte, string, error) {
+	for {
+		msg, more := <-this.channel
+		if !more {
+			return nil, "", io.EOF
+		}
+
+		switch msg.Header.Type {
+		case dto.Type_TCP_CONNECTION_CLOSED:
+			this.Close()
+			return nil, "", io.EOF
+
+		case dto.Type_UDP_DATAGRAM:
+			address := net.JoinHostPort(msg.Payload.GetAddress(), strconv.Itoa(int(msg.Payload.GetPort())))
+			return msg.Payload.GetData(), address, nil
+
+		default:
+			log.Println("Unknown type:", msg.Header.Type)
+		}
+	}
+}
+
+// Close releases the UDP socket on the exit server
+func (this *ProxyAssociation) Close() error {
+	this.closeOnce.Do(func() {
+		this.transport.Write(dto.Type_TCP_CONNECTION_CLOSED, this.connectionId, nil)
+		this.transport.UnregisterChannel(this.connectionId, this.channel)
+	})
+	return nil
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"../comm"
+	"../dto"
+)
+
+// ProxyBinding waits for the peer to connect to a port the exit server listens on
+type ProxyBinding struct {
+	connection   *ProxyConnection
+	boundAddress string
+}
+
+func NewProxyBinding(address string, port uint16, transport comm.Transport) (*ProxyBinding, error) {
+	connection := &ProxyConnection{
+		transport:    transport,
+		connectionId: newConnectionID(),
+	}
+
+	payload := &dto.Payload{
+		Address: address,
+		Port:    int32(port),
+	}
+
+	connection.channel = make(chan dto.Message, 10)
+	transport.RegisterChannel(connection.connectionId, connection.channel)
+
+	err := transport.Write(dto.Type_TCP_BIND, connection.connectionId, payload)
+	if err != nil {
+		transport.UnregisterChannel(connection.connectionId, connection.channel)
+		return nil, err
+	}
+
+	instance := &ProxyBinding{
+		connection: connection,
+	}
+	select {
+	case msg := <-connection.channel:
+		if msg.Header.Type == dto.Type_TCP_CONNECTION_FAILED {
+			transport.UnregisterChannel(connection.connectionId, connection.channel)
+			return nil, dto.ErrorOf(msg.Payload, "Unspecific error on binding")
+		} else if msg.Header.Type != dto.Type_TCP_BOUND {
+			transport.UnregisterChannel(connection.connectionId, connection.channel)
+			return nil, errors.New(fmt.Sprintf("Unknown response type %v", msg.Header.Type))
+		}
+		instance.boundAddress = net.JoinHostPort(msg.Payload.GetAddress(), strconv.Itoa(int(msg.Payload.GetPort())))
+
+	case <-time.After(45 * time.Second):
+		transport.UnregisterChannel(connection.connectionId, connection.channel)
+		return nil, dto.NewError(dto.ErrorCode_TIMEOUT, "Port cannot be bound within 45 seconds")
+	}
+
+	return instance, nil
+}
+
+func (this *ProxyBinding) BoundAddress() string {
+	return this.boundAddress
+}
+
+// Accept waits until the peer connects, the server gives up if no peer comes in time.
+// The binding is closed if it fails
+func (this *ProxyBinding) Accept() (net.Conn, string, error) {
+	msg, more := <-this.connection.channel
+	if !more {
+		this.connection.Close()
+		return nil, "", errors.New("The binding is closed")
+	}
+
+	switch msg.Header.Type {
+	case dto.Type_TCP_CONNECTION_ESTABLISHED:
+		peerAddress := net.JoinHostPort(msg.Payload.GetAddress(), strconv.Itoa(int(msg.Payload.GetPort())))
+		return this.connection, peerAddress, nil
+
+	case dto.Type_TCP_CONNECTION_FAILED:
+		this.connection.Close()
+		return nil, "", dto.ErrorOf(msg.Payload, "Unspecific error on binding")
+
+	default:
+		this.connection.Close()
+		return nil, "", errors.New(fmt.Sprintf("Unknown response type %v", msg.Header.Type))
+	}
+}
+
+// Close stops listening on the exit server, closing the connection tells it
+func (this *ProxyBinding) Close() error {
+	return this.connection.Close()
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,19 +20,38 @@ type ProxyConnection struct {
 	connectionId   int64
 	channel        chan dto.Message
 	remainingBytes []byte
+	remaining      dto.Message // the message the remaining bytes are sliced from, released once they are read
+	localAddr      net.Addr    // the address bound on the exit server
+	peerClosed     int32       // set if the exit server has closed the connection
+	closed         int32
+	closeOnce      sync.Once
+	flowMutex      sync.Mutex
+	pauses         int           // the exit server and the broker each ask to pause and resume on their own
+	resumed        chan struct{} // not nil while paused, closed once every pause is resumed
 }
 
 var count uint32 = 0
 var connectionIdBase int64 = int64(rand.New(rand.NewSource(time.Now().UnixNano())).Int31()) * 4294967296
 
+func newConnectionID() int64 {
+	seq := atomic.AddUint32(&count, 1)
+	return connectionIdBase + int64(seq)
+}
+
+// how long the exit server may take to connect, unless specified
+const proxyConnectTimeout = 45 * time.Second
+
 func NewProxyConnection(address string, port uint16, transport comm.Transport) (*ProxyConnection, error) {
+	return NewProxyConnectionWithTimeout(address, port, transport, proxyConnectTimeout)
+}
+
+func NewProxyConnectionWithTimeout(address string, port uint16, transport comm.Transport, timeout time.Duration) (*ProxyConnection, error) {
 	instance := &ProxyConnection{
 		transport: transport,
 	}
 
 	// generate a unique connection id
-	seq := atomic.AddUint32(&count, 1)
-	instance.connectionId = connectionIdBase + int64(seq)
+	instance.connectionId = newConnectionID()
 
 	// construct the payload
 	payload := &dto.Payload{
@@ -54,57 +74,134 @@ func NewProxyConnection(address string, port uint16, transport comm.Transport) (
 	case msg := <-instance.channel:
 		if msg.Header.Type == dto.Type_TCP_CONNECTION_FAILED {
 			transport.UnregisterChannel(instance.connectionId, instance.channel)
-			if msg.Payload != nil && len(msg.Payload.ErrorMessage) > 0 {
-				return nil, errors.New(msg.Payload.ErrorMessage)
-			}
-			return nil, errors.New("Unspecific error on connection")
+			return nil, dto.ErrorOf(msg.Payload, "Unspecific error on connection")
 		} else if msg.Header.Type != dto.Type_TCP_CONNECTION_ESTABLISHED {
 			transport.UnregisterChannel(instance.connectionId, instance.channel)
 			return nil, errors.New(fmt.Sprintf("Unknown response type %v", msg.Header.Type))
 		}
+		if msg.Payload != nil {
+			ip := net.ParseIP(msg.Payload.Address)
+			if ip != nil {
+				instance.localAddr = &net.TCPAddr{IP: ip, Port: int(msg.Payload.Port)}
+			}
+		}
 
-	case <-time.After(45 * time.Second):
+	case <-time.After(timeout):
+		// the exit server should not connect any more
+		transport.Write(dto.Type_TCP_CONNECTION_CLOSED, instance.connectionId, nil)
 		transport.UnregisterChannel(instance.connectionId, instance.channel)
-		return nil, errors.New("Connection cannot be established within 30 seconds")
+		return nil, dto.NewError(dto.ErrorCode_TIMEOUT, fmt.Sprintf("Connection cannot be established within %v", timeout))
 	}
 
 	return instance, nil
 }
 
+// NewAcceptedProxyConnection relays a connection the exit server accepted for reverse forwarding
+func NewAcceptedProxyConnection(connectionId int64, transport comm.Transport) *ProxyConnection {
+	instance := &ProxyConnection{
+		transport:    transport,
+		connectionId: connectionId,
+	}
+	instance.channel = make(chan dto.Message, 10)
+	transport.RegisterChannel(instance.connectionId, instance.channel)
+	return instance
+}
+
 func (this *ProxyConnection) Read(b []byte) (n int, err error) {
 	if len(this.remainingBytes) > 0 {
 		n := copy(b, this.remainingBytes)
 		this.remainingBytes = this.remainingBytes[n:]
+		if len(this.remainingBytes) == 0 {
+			this.remaining.Release()
+			this.remaining = dto.Message{}
+		}
 		return n, nil
 	}
 
-	msg, more := <-this.channel
-	if !more {
-		this.Close()
-		return 0, io.EOF
-	}
+	for {
+		msg, more := <-this.channel
+		if !more {
+			this.Close()
+			return 0, io.EOF
+		}
 
-	switch msg.Header.Type {
-	case dto.Type_TCP_CONNECTION_CLOSED:
-		this.Close()
-		return 0, io.EOF
+		switch msg.Header.Type {
+		case dto.Type_TCP_CONNECTION_CLOSED:
+			atomic.StoreInt32(&this.peerClosed, 1)
+			this.Close()
+			return 0, io.EOF
+
+		case dto.Type_INBOUND_DATA:
+			data := msg.Payload.GetData()
+			n := copy(b, data)
+			if n < len(data) { // not all data is copied
+				this.remainingBytes = data[n:]
+				this.remaining = msg
+			} else {
+				msg.Release()
+			}
+			return n, nil
+
+		case dto.Type_FLOW_PAUSE:
+			this.pause()
+
+		case dto.Type_FLOW_RESUME:
+			this.resume()
 
-	case dto.Type_INBOUND_DATA:
-		data := msg.Payload.GetData()
-		n := copy(b, data)
-		if n < len(data) { // not all data is copied
-			this.remainingBytes = data[n:]
+		default:
+			log.Println("Unknown type:", msg.Header.Type)
+			return 0, nil
 		}
-		return n, nil
+	}
+}
+
+func (this *ProxyConnection) pause() {
+	this.flowMutex.Lock()
+	defer this.flowMutex.Unlock()
+
+	this.pauses++
+	if this.resumed == nil {
+		this.resumed = make(chan struct{})
+	}
+}
 
-	default:
-		log.Println("Unknown type:", msg.Header.Type)
+func (this *ProxyConnection) resume() {
+	this.flowMutex.Lock()
+	defer this.flowMutex.Unlock()
+
+	if this.pauses > 0 {
+		this.pauses--
+	}
+	if this.pauses == 0 && this.resumed != nil {
+		close(this.resumed)
+		this.resumed = nil
 	}
+}
+
+// resumeAll wakes up the writers whoever asked to pause
+func (this *ProxyConnection) resumeAll() {
+	this.flowMutex.Lock()
+	this.pauses = 0
+	this.flowMutex.Unlock()
+	this.resume()
+}
 
-	return 0, nil
+// waitResumed blocks while the exit server or the broker asks to pause
+func (this *ProxyConnection) waitResumed() {
+	this.flowMutex.Lock()
+	resumed := this.resumed
+	this.flowMutex.Unlock()
+
+	if resumed != nil {
+		<-resumed
+	}
 }
 
 func (this *ProxyConnection) Write(data []byte) (n int, err error) {
+	this.waitResumed()
+	if atomic.LoadInt32(&this.closed) != 0 {
+		return 0, io.ErrClosedPipe
+	}
 	if len(data) > 0 {
 		payload := &dto.Payload{
 			Data: data,
@@ -119,13 +216,21 @@ func (this *ProxyConnection) Write(data []byte) (n int, err error) {
 	return len(data), nil
 }
 
+// Close tells the exit server to close the connection too, unless it is the one closing
 func (this *ProxyConnection) Close() error {
-	this.transport.UnregisterChannel(this.connectionId, this.channel)
+	this.closeOnce.Do(func() {
+		atomic.StoreInt32(&this.closed, 1)
+		this.resumeAll() // writers must not wait any more
+		if atomic.LoadInt32(&this.peerClosed) == 0 {
+			this.transport.Write(dto.Type_TCP_CONNECTION_CLOSED, this.connectionId, nil)
+		}
+		this.transport.UnregisterChannel(this.connectionId, this.channel)
+	})
 	return nil
 }
 
 func (c *ProxyConnection) LocalAddr() net.Addr {
-	return nil
+	return c.localAddr
 }
 
 func (c *ProxyConnection) RemoteAddr() net.Addr {
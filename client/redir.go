@@ -0,0 +1,89 @@
+package client
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// serveRedir accepts the connections redirected by the firewall, whose destinations are recovered from the sockets.
+// The firewall must not redirect the connections of this process, or they loop forever
+func (this *ProxyClient) serveRedir(listener net.Listener, tproxy bool) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			this.handleError(err)
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go this.handleRedir(conn, listener.Addr(), tproxy)
+	}
+}
+
+func (this *ProxyClient) handleRedir(conn net.Conn, listenerAddr net.Addr, tproxy bool) {
+	address, err := originalDestination(conn, tproxy)
+	if err != nil {
+		log.Println("Unable to find the original destination of", conn.RemoteAddr(), ",", err)
+		conn.Close()
+		return
+	}
+	if isListenerAddress(address, listenerAddr) {
+		log.Println("Connection from", conn.RemoteAddr(), "is not redirected")
+		conn.Close()
+		return
+	}
+
+	// the application has connected already, there is nothing to reply
+	data, name := this.sniff(conn, address, func() {})
+	remoteConn, err := this.dialAs("tcp", address, name)
+	if err != nil {
+		log.Println("Unable to dial", address, ",", err)
+		conn.Close()
+		return
+	}
+	if len(data) > 0 {
+		if _, err = remoteConn.Write(data); err != nil {
+			remoteConn.Close()
+			conn.Close()
+			return
+		}
+	}
+	go this.transfer(remoteConn, conn)
+	go this.transfer(conn, remoteConn)
+}
+
+// isListenerAddress tells if the destination is the listener itself, which happens when the connection is not redirected
+func isListenerAddress(address string, listenerAddr net.Addr) bool {
+	tcpAddr, ok := listenerAddr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || port != strconv.Itoa(tcpAddr.Port) {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if !tcpAddr.IP.IsUnspecified() {
+		return ip.Equal(tcpAddr.IP)
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST in linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST in linux/netfilter_ipv6/ip6_tables.h
+	ipv6Transparent   = 75 // IPV6_TRANSPARENT in linux/in6.h
+)
+
+// listenRedir listens for redirected connections. TPROXY requires IP_TRANSPARENT, and CAP_NET_ADMIN for it
+func listenRedir(address string, tproxy bool) (net.Listener, error) {
+	listenConfig := &net.ListenConfig{}
+	if tproxy {
+		listenConfig.Control = func(network, address string, rawConn syscall.RawConn) error {
+			var sockErr error
+			err := rawConn.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if sockErr == nil && network == "tcp6" {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return listenConfig.Listen(context.Background(), "tcp", address)
+}
+
+// originalDestination returns the address the application connected to.
+// TPROXY keeps it as the local address, while REDIRECT keeps it in the conntrack entry
+func originalDestination(conn net.Conn, tproxy bool) (string, error) {
+	if tproxy {
+		return conn.LocalAddr().String(), nil
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Unsupported connection %T", conn))
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	// sockaddr_in and sockaddr_in6 both fit
+	var addr [syscall.SizeofSockaddrInet6]byte
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		level, name := syscall.SOL_IP, soOriginalDst
+		if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+			level, name = syscall.SOL_IPV6, ip6tSoOriginalDst
+		}
+		size := uint32(len(addr))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(name),
+			uintptr(unsafe.Pointer(&addr[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", sockErr
+	}
+
+	// the family is in host byte order, while the port is in network byte order
+	var ip net.IP
+	switch *(*uint16)(unsafe.Pointer(&addr[0])) {
+	case syscall.AF_INET:
+		ip = net.IP(addr[4:8])
+	case syscall.AF_INET6:
+		ip = net.IP(addr[8:24])
+	default:
+		return "", errors.New("Unknown address family of the original destination")
+	}
+	port := binary.BigEndian.Uint16(addr[2:4])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+var errRedirNotSupported = errors.New("Transparent proxy is only supported on Linux")
+
+func listenRedir(address string, tproxy bool) (net.Listener, error) {
+	return nil, errRedirNotSupported
+}
+
+func originalDestination(conn net.Conn, tproxy bool) (string, error) {
+	return "", errRedirNotSupported
+}
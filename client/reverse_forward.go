@@ -0,0 +1,173 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"../config"
+	"../dto"
+)
+
+const (
+	reverseForwardMinDelay = 5 * time.Second // before listening again once the listener is closed
+	reverseForwardMaxDelay = 5 * time.Minute
+	reverseDialTimeout     = 10 * time.Second
+)
+
+// ReverseForward has the exit server listen on a port, and relays the connections accepted to a local address.
+// The broker decides whether the port is granted, and the listener is requested again whenever it is lost
+type ReverseForward struct {
+	client *ProxyClient
+	host   string
+	port   uint16
+	local  string
+}
+
+func NewReverseForward(client *ProxyClient, forward config.ReverseForward) *ReverseForward {
+	host, portText, _ := net.SplitHostPort(forward.Listen)
+	port, err := strconv.Atoi(portText)
+	if err != nil || port <= 0 || port > 65535 {
+		panic("`listen` of `reverseForwards` has an invalid port, please check your configuration file")
+	}
+	return &ReverseForward{
+		client: client,
+		host:   host,
+		port:   uint16(port),
+		local:  forward.Local,
+	}
+}
+
+func (this *ReverseForward) Start() {
+	go this.run()
+}
+
+func (this *ReverseForward) run() {
+	delay := reverseForwardMinDelay
+	for {
+		start := time.Now()
+		err := this.listen()
+		if time.Since(start) > reverseForwardMaxDelay {
+			delay = reverseForwardMinDelay // it was listening for a while
+		}
+		log.Println("Reverse forwarding of port", this.port, "to", this.local, "stopped :", err, ", retry in", delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > reverseForwardMaxDelay {
+			delay = reverseForwardMaxDelay
+		}
+	}
+}
+
+// listen requests the listener, and blocks until it is closed
+func (this *ReverseForward) listen() error {
+	transport := this.client.transport
+	listenerID := newConnectionID()
+	channel := make(chan dto.Message, 10)
+	transport.RegisterChannel(listenerID, channel)
+	this.client.addReverseForward(listenerID, this)
+	defer (func() {
+		this.client.removeReverseForward(listenerID)
+		transport.UnregisterChannel(listenerID, channel)
+	})()
+
+	payload := &dto.Payload{
+		Address: this.host,
+		Port:    int32(this.port),
+	}
+	err := transport.Write(dto.Type_REVERSE_LISTEN, listenerID, payload)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case msg := <-channel:
+		if msg.Header.Type == dto.Type_TCP_CONNECTION_FAILED {
+			return dto.ErrorOf(msg.Payload, "Unspecific error on listening")
+		} else if msg.Header.Type != dto.Type_TCP_BOUND {
+			transport.Write(dto.Type_TCP_CONNECTION_CLOSED, listenerID, nil)
+			return errors.New(fmt.Sprintf("Unknown response type %v", msg.Header.Type))
+		}
+		address := net.JoinHostPort(msg.Payload.GetAddress(), strconv.Itoa(int(msg.Payload.GetPort())))
+		log.Println("Exit server is listening on", address, "for", this.local)
+
+	case <-time.After(proxyConnectTimeout):
+		transport.Write(dto.Type_TCP_CONNECTION_CLOSED, listenerID, nil)
+		return dto.NewError(dto.ErrorCode_TIMEOUT, fmt.Sprintf("Port cannot be listened within %v", proxyConnectTimeout))
+	}
+
+	for {
+		msg, more := <-channel
+		if !more {
+			return errors.New("The listener is closed")
+		}
+		if msg.Header.Type == dto.Type_TCP_CONNECTION_CLOSED {
+			return dto.ErrorOf(msg.Payload, "The listener is closed")
+		}
+		log.Println("Unknown type:", msg.Header.Type)
+	}
+}
+
+// accept dials the local address for the connection the exit server accepted
+func (this *ReverseForward) accept(msg dto.Message) {
+	transport := this.client.transport
+	connectionID := msg.Header.ConnectionID
+	peer := net.JoinHostPort(msg.Payload.GetAddress(), strconv.Itoa(int(msg.Payload.GetPort())))
+
+	conn, err := net.DialTimeout("tcp", this.local, reverseDialTimeout)
+	if err != nil {
+		log.Println("Unable to dial", this.local, "for", peer, ",", err)
+		transport.Write(dto.Type_TCP_CONNECTION_FAILED, connectionID, dto.NewErrorPayload(err))
+		return
+	}
+
+	// the channel is registered before the exit server starts sending
+	proxyConn := NewAcceptedProxyConnection(connectionID, transport)
+	err = transport.Write(dto.Type_TCP_CONNECTION_ESTABLISHED, connectionID, nil)
+	if err != nil {
+		proxyConn.Close()
+		conn.Close()
+		return
+	}
+	go this.client.transfer(proxyConn, conn)
+	go this.client.transfer(conn, proxyConn)
+}
+
+// dispatchReverseConnections handles the messages for unknown connections, which open reverse forwarded connections
+func (this *ProxyClient) dispatchReverseConnections(channel chan dto.Message) {
+	for msg := range channel {
+		if msg.Header.Type != dto.Type_REVERSE_CONNECT || msg.Payload == nil {
+			continue // messages of connections already closed
+		}
+		forward := this.getReverseForward(msg.Payload.ListenerID)
+		if forward == nil {
+			payload := &dto.Payload{
+				ErrorCode:    dto.ErrorCode_CONNECTION_NOT_FOUND,
+				ErrorMessage: fmt.Sprintf("Unable to find the listener whose id is %v", msg.Payload.ListenerID),
+			}
+			this.transport.Write(dto.Type_TCP_CONNECTION_FAILED, msg.Header.ConnectionID, payload)
+			continue
+		}
+		go forward.accept(msg)
+	}
+}
+
+func (this *ProxyClient) addReverseForward(listenerID int64, forward *ReverseForward) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.reverseForwards[listenerID] = forward
+}
+
+func (this *ProxyClient) removeReverseForward(listenerID int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.reverseForwards, listenerID)
+}
+
+func (this *ProxyClient) getReverseForward(listenerID int64) *ReverseForward {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.reverseForwards[listenerID]
+}
@@ -0,0 +1,321 @@
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../config"
+)
+
+// RuleSet layers the rule lists loaded from multiple sources.
+// The first list which has a rule matching the host decides if it is blocked
+type RuleSet struct {
+	sources    []*ruleSource
+	lists      atomic.Value // []*GFWList, replaced as a whole when any source is reloaded
+	mutex      sync.Mutex
+	httpClient *http.Client
+	cacheDir   string
+}
+
+type ruleSource struct {
+	config.RuleSource
+	list         *GFWList
+	etag         string
+	lastModified string
+	modTime      time.Time // modification time of the local file
+	retryDelay   time.Duration
+}
+
+// the metadata saved next to a cached rule list
+type ruleCacheMeta struct {
+	Url          string `json:"url"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"lastModified"`
+}
+
+const minRuleRetryDelay = 5 * time.Second
+
+func NewRuleSet(sources []config.RuleSource, cacheDir string, httpClient *http.Client) *RuleSet {
+	this := &RuleSet{
+		sources:    make([]*ruleSource, 0, len(sources)),
+		httpClient: httpClient,
+		cacheDir:   cacheDir,
+	}
+	for _, source := range sources {
+		this.sources = append(this.sources, &ruleSource{RuleSource: source})
+	}
+	this.lists.Store([]*GFWList{})
+	return this
+}
+
+// Start loads the cached copies immediately, then refreshes every source in background.
+// Remote sources are first fetched after `delay` to give the tunnel a chance to be connected
+func (this *RuleSet) Start(delay time.Duration) {
+	for _, source := range this.sources {
+		if len(source.Url) > 0 {
+			this.loadCache(source)
+		} else {
+			list, err := this.loadFile(source)
+			if err != nil {
+				log.Println("Unable to load rules from", source.File, ",", err)
+			}
+			source.list = list
+		}
+	}
+	this.swap(nil, nil)
+
+	for _, source := range this.sources {
+		source := source
+		if len(source.Url) > 0 {
+			time.AfterFunc(delay, func() { this.refresh(source) })
+		} else {
+			interval := time.Duration(source.RefreshInterval) * time.Second
+			time.AfterFunc(interval, func() { this.refresh(source) })
+		}
+	}
+}
+
+// Match tells if any list matches the host, and if so, whether the host is blocked
+func (this *RuleSet) Match(host string) (matched bool, blocked bool) {
+	lists := this.lists.Load().([]*GFWList)
+	for _, list := range lists {
+		matched, blocked = list.Match(host)
+		if matched {
+			return
+		}
+	}
+	return false, false
+}
+
+func (this *RuleSet) IsBlocked(host string) bool {
+	_, blocked := this.Match(host)
+	return blocked
+}
+
+// swap replaces the list of the source, and publishes the lists of all sources in order as a new snapshot
+func (this *RuleSet) swap(source *ruleSource, list *GFWList) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if source != nil {
+		source.list = list
+	}
+	lists := make([]*GFWList, 0, len(this.sources))
+	for _, source := range this.sources {
+		if source.list != nil {
+			lists = append(lists, source.list)
+		}
+	}
+	this.lists.Store(lists)
+}
+
+func (this *RuleSet) refresh(source *ruleSource) {
+	var list *GFWList
+	var err error
+	if len(source.Url) > 0 {
+		list, err = this.download(source)
+	} else {
+		list, err = this.loadFile(source)
+	}
+
+	interval := time.Duration(source.RefreshInterval) * time.Second
+	if err != nil {
+		log.Println("Unable to refresh rules from", source.name(), ",", err)
+
+		// back off until the regular interval is reached
+		if source.retryDelay < minRuleRetryDelay {
+			source.retryDelay = minRuleRetryDelay
+		} else {
+			source.retryDelay *= 2
+		}
+		if source.retryDelay < interval {
+			interval = source.retryDelay
+		}
+	} else {
+		source.retryDelay = 0
+		if list != nil {
+			this.swap(source, list)
+			log.Println("Loaded rules from", source.name())
+		}
+	}
+
+	time.AfterFunc(interval, func() { this.refresh(source) })
+}
+
+// download fetches the list from the url, it returns nil if the list is not modified
+func (this *RuleSet) download(source *ruleSource) (*GFWList, error) {
+	request, err := http.NewRequest(http.MethodGet, source.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if source.list != nil {
+		if len(source.etag) > 0 {
+			request.Header.Set("If-None-Match", source.etag)
+		}
+		if len(source.lastModified) > 0 {
+			request.Header.Set("If-Modified-Since", source.lastModified)
+		}
+	}
+
+	resp, err := this.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("GET %v returned HTTP status code : %v", source.Url, resp.StatusCode))
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	list, err := ParseRuleList(string(content), source.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	source.etag = resp.Header.Get("ETag")
+	source.lastModified = resp.Header.Get("Last-Modified")
+	this.saveCache(source, content)
+	return list, nil
+}
+
+// loadFile reads the local file, it returns nil if the file is not modified since last time
+func (this *RuleSet) loadFile(source *ruleSource) (*GFWList, error) {
+	info, err := os.Stat(source.File)
+	if err != nil {
+		return nil, err
+	}
+	if !source.modTime.IsZero() && info.ModTime().Equal(source.modTime) {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(source.File)
+	if err != nil {
+		return nil, err
+	}
+	list, err := ParseRuleList(string(content), source.Format)
+	if err != nil {
+		return nil, err
+	}
+	source.modTime = info.ModTime()
+	return list, nil
+}
+
+func (this *RuleSet) cacheFile(source *ruleSource) string {
+	hash := sha1.Sum([]byte(source.Url))
+	return filepath.Join(this.cacheDir, hex.EncodeToString(hash[:])+".txt")
+}
+
+func (this *RuleSet) loadCache(source *ruleSource) {
+	if len(this.cacheDir) == 0 {
+		return
+	}
+	file := this.cacheFile(source)
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return
+	}
+	list, err := ParseRuleList(string(content), source.Format)
+	if err != nil {
+		log.Println("Ignored the corrupted cache", file, ",", err)
+		return
+	}
+	source.list = list
+
+	meta := &ruleCacheMeta{}
+	buffer, err := ioutil.ReadFile(file + ".meta")
+	if err == nil && json.Unmarshal(buffer, meta) == nil && meta.Url == source.Url {
+		source.etag = meta.ETag
+		source.lastModified = meta.LastModified
+	}
+	log.Println("Loaded cached rules of", source.Url, "from", file)
+}
+
+func (this *RuleSet) saveCache(source *ruleSource, content []byte) {
+	if len(this.cacheDir) == 0 {
+		return
+	}
+	// only the user may write the rules
+	err := os.MkdirAll(this.cacheDir, 0700)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	file := this.cacheFile(source)
+	err = writeFileAtomically(file, content)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	meta := &ruleCacheMeta{
+		Url:          source.Url,
+		ETag:         source.etag,
+		LastModified: source.lastModified,
+	}
+	buffer, err := json.Marshal(meta)
+	if err == nil {
+		err = writeFileAtomically(file+".meta", buffer)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// writeFileAtomically writes to a temporary file and then renames it,
+// so that a crash never leaves a truncated cache behind
+func writeFileAtomically(file string, content []byte) error {
+	tmpFile := file + ".tmp"
+	err := ioutil.WriteFile(tmpFile, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+func (this *ruleSource) name() string {
+	if len(this.Url) > 0 {
+		return this.Url
+	}
+	return this.File
+}
+
+// ParseRuleList parses the content in the specified format.
+// If the format is empty, base64 is tried first and then plain text
+func ParseRuleList(content string, format string) (*GFWList, error) {
+	switch format {
+	case config.RuleFormatBase64:
+		return ParseRawGFWList(content)
+	case config.RuleFormatPlain:
+		return Parse(content)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content))
+	if err == nil {
+		return Parse(string(decoded))
+	}
+	return Parse(content)
+}
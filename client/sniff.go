@@ -0,0 +1,205 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	sniffTimeout    = 300 * time.Millisecond // protocols where the server speaks first never send anything
+	sniffBufferSize = 16 * 1024
+)
+
+// sniffPorts are the ports of HTTP and HTTPS, where the client speaks first.
+// The requests to other ports are replied after dialing and sent as they are
+var sniffPorts = map[string]bool{"80": true, "443": true}
+
+// sniffable tells if the address is a public IP literal on a port where the client speaks first
+func sniffable(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || !sniffPorts[port] {
+		return false
+	}
+	return net.ParseIP(host) != nil && !isPrivateIP(host)
+}
+
+// sniff peeks at the first bytes the application sends to an IP literal, if sniffing is enabled.
+// The TLS server name or the HTTP Host header found is returned, to be given to dialAs().
+// The bytes read are returned and must be sent before anything else.
+// reply() is called before reading because applications wait for the proxy to reply
+func (this *ProxyClient) sniff(conn net.Conn, address string, reply func()) ([]byte, string) {
+	if !this.sniffing || !sniffable(address) {
+		return nil, ""
+	}
+	host, _, _ := net.SplitHostPort(address)
+	if this.fakeIPs != nil && this.fakeIPs.Contains(host) {
+		return nil, "" // dial() knows the name already
+	}
+
+	reply()
+	buffer := make([]byte, sniffBufferSize)
+	length := 0
+	domain := ""
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	for length < len(buffer) {
+		n, err := conn.Read(buffer[length:])
+		length += n
+		if err != nil {
+			break
+		}
+
+		var complete bool
+		domain, complete = sniffHost(buffer[:length])
+		if complete {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if len(domain) > 0 {
+		log.Println("Sniffed", domain, "for", address)
+	}
+	return buffer[:length], domain
+}
+
+// sniffHost looks for the server name in a TLS ClientHello or a HTTP request.
+// complete is false if more data is needed to decide
+func sniffHost(data []byte) (host string, complete bool) {
+	if len(data) == 0 {
+		return "", false
+	}
+	if data[0] == 0x16 { // TLS handshake record
+		return sniffServerName(data)
+	}
+	return sniffHttpHost(data)
+}
+
+func sniffServerName(data []byte) (string, bool) {
+	if len(data) < 5 {
+		return "", false
+	}
+	recordLength := int(binary.BigEndian.Uint16(data[3:5]))
+	if len(data) < 5+recordLength {
+		return "", false
+	}
+	data = data[5 : 5+recordLength]
+
+	// handshake header : type(1) length(3)
+	if len(data) < 4 || data[0] != 0x01 {
+		return "", true
+	}
+	data = data[4:]
+
+	// client_version(2) random(32)
+	if len(data) < 34 {
+		return "", true
+	}
+	data = data[34:]
+
+	// session_id, cipher_suites, compression_methods
+	for _, size := range []int{1, 2, 1} {
+		if len(data) < size {
+			return "", true
+		}
+		length := int(data[0])
+		if size == 2 {
+			length = int(binary.BigEndian.Uint16(data))
+		}
+		if len(data) < size+length {
+			return "", true
+		}
+		data = data[size+length:]
+	}
+
+	if len(data) < 2 {
+		return "", true
+	}
+	extensionsLength := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < extensionsLength {
+		return "", true
+	}
+	data = data[:extensionsLength]
+
+	for len(data) >= 4 {
+		extensionType := binary.BigEndian.Uint16(data)
+		extensionLength := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+		if len(data) < extensionLength {
+			return "", true
+		}
+		if extensionType == 0 { // server_name
+			extension := data[:extensionLength]
+			if len(extension) < 2 {
+				return "", true
+			}
+			extension = extension[2:]
+			for len(extension) >= 3 {
+				nameType := extension[0]
+				nameLength := int(binary.BigEndian.Uint16(extension[1:]))
+				extension = extension[3:]
+				if len(extension) < nameLength {
+					return "", true
+				}
+				if nameType == 0 { // host_name
+					return strings.ToLower(string(extension[:nameLength])), true
+				}
+				extension = extension[nameLength:]
+			}
+			return "", true
+		}
+		data = data[extensionLength:]
+	}
+	return "", true
+}
+
+var httpMethods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE ", "CONNECT "}
+
+func sniffHttpHost(data []byte) (string, bool) {
+	isHttp := false
+	for _, method := range httpMethods {
+		prefix := []byte(method)
+		if len(data) < len(prefix) {
+			if bytes.HasPrefix(prefix, data) {
+				return "", false
+			}
+		} else if bytes.HasPrefix(data, prefix) {
+			isHttp = true
+			break
+		}
+	}
+	if !isHttp {
+		return "", true
+	}
+
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	complete := end >= 0
+	if !complete {
+		end = len(data)
+	}
+
+	lines := strings.Split(string(data[:end]), "\r\n")
+	if !complete {
+		lines = lines[:len(lines)-1] // the last line may be truncated
+	}
+	for i := 1; i < len(lines); i++ {
+		line := lines[i]
+		idx := strings.Index(line, ":")
+		if idx < 0 || !strings.EqualFold(strings.TrimSpace(line[:idx]), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(line[idx+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) != nil {
+			return "", true // nothing better than the address
+		}
+		return strings.ToLower(host), true
+	}
+	return "", complete
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// clientHello builds a TLS record with a ClientHello, carrying the server name if it is not empty
+func clientHello(serverName string) []byte {
+	var extensions []byte
+	extensions = append(extensions, 0x00, 0x0b, 0x00, 0x02, 0x01, 0x00) // ec_point_formats
+	if len(serverName) > 0 {
+		name := append([]byte{0x00, 0x00, 0x00}, serverName...) // host_name
+		binary.BigEndian.PutUint16(name[1:], uint16(len(serverName)))
+		list := append(make([]byte, 2), name...)
+		binary.BigEndian.PutUint16(list, uint16(len(name)))
+		extension := append([]byte{0x00, 0x00, 0x00, 0x00}, list...)
+		binary.BigEndian.PutUint16(extension[2:], uint16(len(list)))
+		extensions = append(extensions, extension...)
+	}
+
+	body := []byte{0x03, 0x03}               // client_version
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0x00)                // session_id
+	body = append(body, 0x00, 0x02, 0x13, 0x01)
+	body = append(body, 0x01, 0x00) // compression_methods
+	body = append(body, byte(len(extensions)>>8), byte(len(extensions)))
+	body = append(body, extensions...)
+
+	handshake := append([]byte{0x01, 0x00, byte(len(body) >> 8), byte(len(body))}, body...)
+	record := []byte{0x16, 0x03, 0x01, byte(len(handshake) >> 8), byte(len(handshake))}
+	return append(record, handshake...)
+}
+
+func TestSniffServerName(t *testing.T) {
+	hello := clientHello("Www.Example.com")
+	serverHello := clientHello("example.com")
+	serverHello[5] = 0x02
+
+	tests := []struct {
+		name     string
+		data     []byte
+		host     string
+		complete bool
+	}{
+		{"server name", hello, "www.example.com", true},
+		{"without server name", clientHello(""), "", true},
+		{"record header only", hello[:3], "", false},
+		{"truncated record", hello[:len(hello)-1], "", false},
+		{"truncated before the extensions", hello[:20], "", false},
+		{"not a ClientHello", serverHello, "", true},
+		{"inconsistent extension length", corrupt(hello, len(hello)-len("Www.Example.com")-2), "", true},
+	}
+	for _, test := range tests {
+		host, complete := sniffServerName(test.data)
+		if host != test.host || complete != test.complete {
+			t.Errorf("%v : got (%q, %v), want (%q, %v)", test.name, host, complete, test.host, test.complete)
+		}
+	}
+}
+
+// corrupt returns a copy of the data with the 16 bits at offset set to the maximum
+func corrupt(data []byte, offset int) []byte {
+	copied := append([]byte{}, data...)
+	copied[offset] = 0xFF
+	copied[offset+1] = 0xFF
+	return copied
+}
+
+func TestSniffHttpHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		host     string
+		complete bool
+	}{
+		{"host", "GET / HTTP/1.1\r\nUser-Agent: test\r\nHost: Example.com\r\n\r\n", "example.com", true},
+		{"host with port", "POST /x HTTP/1.1\r\nhost: example.com:8080\r\n\r\n", "example.com", true},
+		{"host before the end of headers", "GET / HTTP/1.1\r\nHost: example.com\r\nAccept", "example.com", true},
+		{"without host", "GET / HTTP/1.0\r\nUser-Agent: test\r\n\r\n", "", true},
+		{"host of an IP", "GET / HTTP/1.1\r\nHost: 93.184.216.34\r\n\r\n", "", true},
+		{"truncated host", "GET / HTTP/1.1\r\nHost: exam", "", false},
+		{"truncated method", "GE", "", false},
+		{"request line only", "GET / HTTP/1.1\r\n", "", false},
+		{"not HTTP", "SSH-2.0-OpenSSH_8.9\r\n", "", true},
+		{"empty", "", "", false},
+	}
+	for _, test := range tests {
+		host, complete := sniffHttpHost([]byte(test.data))
+		if host != test.host || complete != test.complete {
+			t.Errorf("%v : got (%q, %v), want (%q, %v)", test.name, host, complete, test.host, test.complete)
+		}
+	}
+}
+
+func TestSniffable(t *testing.T) {
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"93.184.216.34:443", true},
+		{"93.184.216.34:80", true},
+		{"[2606:2800:220:1::]:443", true},
+		{"93.184.216.34:22", false},
+		{"93.184.216.34:25", false},
+		{"192.168.1.1:443", false},
+		{"example.com:443", false},
+		{"93.184.216.34", false},
+	}
+	for _, test := range tests {
+		if got := sniffable(test.address); got != test.want {
+			t.Errorf("sniffable(%q) = %v, want %v", test.address, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package comm
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"../config"
+	"../dto"
+)
+
+const (
+	weightInteractive = 16
+	weightNormal      = 4
+	weightBulk        = 1
+
+	interactiveBytes  = 16 * 1024        // recent bytes of a connection under which it is interactive
+	bulkBytes         = 512 * 1024       // recent bytes of a connection over which it is bulk
+	recentWindow      = time.Second      // how fast the recent bytes decay
+	streamQueueLimit  = 256 * 1024       // bytes queued for a connection before its writers wait, or its sender is paused
+	streamResumeLevel = 64 * 1024        // bytes queued when a paused sender is resumed
+	streamDropLimit   = 16 * 1024 * 1024 // bytes queued for a paused connection before it is given up, the data in flight arrives after pausing
+	streamIdleTimeout = 5 * time.Minute  // how long an idle connection with nothing queued is remembered
+)
+
+// Scheduler queues the frames to write per connection, and picks the next one by weighted fair queuing.
+// The weight of a connection is fixed by the first rule matching its destination, or detected from its traffic :
+// a connection which sent little recently is interactive, one which keeps sending a lot is bulk.
+// The frames of a connection are written in order
+type Scheduler struct {
+	rules       []*priorityRule
+	streams     map[int64]*stream
+	backlog     streamHeap // the streams with frames queued, by the finish tag of their first frame
+	virtualTime float64    // the finish tag of the last frame written
+	ready       chan struct{}
+	closed      bool
+	lastSweep   time.Time
+	mutex       sync.Mutex
+	cond        *sync.Cond // signaled when a connection can queue again
+	onResume    func(connectionID int64)
+}
+
+type priorityRule struct {
+	domains    []string
+	portRanges [][2]int
+	weight     int
+}
+
+type stream struct {
+	connectionID int64
+	weight       int // fixed by a rule, zero if detected from the traffic
+	frames       []queuedFrame
+	queued       int     // bytes of the frames
+	lastFinish   float64 // the finish tag of the last frame queued
+	recent       float64 // bytes queued recently, decaying over recentWindow
+	lastActive   time.Time
+	waiting      int  // writers waiting to queue
+	paused       bool // the sender is asked to pause until the frames queued are written
+	done         bool // the connection has ended, it is forgotten once the frames are written
+	index        int  // in the backlog, -1 if not in it
+}
+
+type queuedFrame struct {
+	data   []byte
+	finish float64
+}
+
+func NewScheduler(scheduling config.Scheduling) *Scheduler {
+	instance := &Scheduler{
+		streams:   make(map[int64]*stream),
+		ready:     make(chan struct{}, 1),
+		lastSweep: time.Now(),
+	}
+	instance.cond = sync.NewCond(&instance.mutex)
+	for _, rule := range scheduling.Rules {
+		r := &priorityRule{
+			portRanges: rule.GetPortRanges(),
+			weight:     weightOf(rule.Priority),
+		}
+		for _, domain := range rule.Domains {
+			domain = strings.Trim(strings.ToLower(domain), ".")
+			if len(domain) > 0 {
+				r.domains = append(r.domains, domain)
+			}
+		}
+		instance.rules = append(instance.rules, r)
+	}
+	return instance
+}
+
+func weightOf(priority string) int {
+	switch priority {
+	case config.PriorityInteractive:
+		return weightInteractive
+	case config.PriorityBulk:
+		return weightBulk
+	default:
+		return weightNormal
+	}
+}
+
+func (this *priorityRule) matches(host string, port int) bool {
+	if len(this.domains) > 0 {
+		host = strings.Trim(strings.ToLower(host), ".")
+		matched := false
+		for _, domain := range this.domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(this.portRanges) > 0 {
+		matched := false
+		for _, portRange := range this.portRanges {
+			if port >= portRange[0] && port <= portRange[1] {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// currentWeight returns the weight the next frame is queued with
+func (this *stream) currentWeight() int {
+	if this.weight > 0 {
+		return this.weight
+	}
+	if this.recent < interactiveBytes {
+		return weightInteractive
+	}
+	if this.recent > bulkBytes {
+		return weightBulk
+	}
+	return weightNormal
+}
+
+func (this *Scheduler) stream(connectionID int64) *stream {
+	s := this.streams[connectionID]
+	if s == nil {
+		s = &stream{
+			connectionID: connectionID,
+			index:        -1,
+		}
+		this.streams[connectionID] = s
+	}
+	return s
+}
+
+// Classify fixes the priority of the connection if a rule matches its destination
+func (this *Scheduler) Classify(connectionID int64, host string, port int) {
+	for _, rule := range this.rules {
+		if rule.matches(host, port) {
+			this.mutex.Lock()
+			this.stream(connectionID).weight = rule.weight
+			this.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// endsConnection tells if no more frames follow for the connection
+func endsConnection(msgType dto.Type) bool {
+	return msgType == dto.Type_TCP_CONNECTION_FAILED || msgType == dto.Type_TCP_CONNECTION_CLOSED || msgType == dto.Type_DNS_RESPONSE
+}
+
+// isRequest tells if the frame asks for a connection, which is replied to with its outcome
+func isRequest(msgType dto.Type) bool {
+	switch msgType {
+	case dto.Type_TCP_CONNECT, dto.Type_DNS_QUERY, dto.Type_UDP_ASSOCIATE, dto.Type_TCP_BIND,
+		dto.Type_REVERSE_LISTEN, dto.Type_REVERSE_CONNECT:
+		return true
+	}
+	return false
+}
+
+// isData tells if the frame carries data of the connection, which is held back while too much is queued.
+// The others are small and control the connection, they are never held back
+func isData(msgType dto.Type) bool {
+	return msgType == dto.Type_OUTBOUND_DATA || msgType == dto.Type_INBOUND_DATA || msgType == dto.Type_UDP_DATAGRAM
+}
+
+// Push queues the frame, it waits while too much data is queued for the connection.
+// Only the writer of a single connection may wait, a reader shared by connections offers instead.
+// The frame is released if the scheduler is closed
+func (this *Scheduler) Push(connectionID int64, msgType dto.Type, frame []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	s := this.stream(connectionID)
+	for isData(msgType) && !this.closed && s.queued >= streamQueueLimit {
+		s.waiting++
+		this.cond.Wait()
+		s.waiting--
+		s = this.stream(connectionID) // forgotten if the connection has ended meanwhile
+	}
+	if this.closed {
+		dto.Release(frame)
+		return errors.New("The connection is closed")
+	}
+	this.queue(s, msgType, frame)
+	return nil
+}
+
+// Offer queues the frame without waiting, for a reader shared by connections.
+// pause tells the sender of the connection should be asked to pause, it is resumed by the callback of OnResume.
+// A datagram is dropped once too much is queued for the connection, and the data of a connection whose sender
+// keeps sending after pausing. The frame is released if it is not queued
+func (this *Scheduler) Offer(connectionID int64, msgType dto.Type, frame []byte) (pause bool, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		dto.Release(frame)
+		return false, errors.New("The connection is closed")
+	}
+	s := this.stream(connectionID)
+	if msgType == dto.Type_UDP_DATAGRAM && s.queued >= streamQueueLimit {
+		dto.Release(frame)
+		return false, dto.NewError(dto.ErrorCode_GENERAL_FAILURE,
+			fmt.Sprintf("Over %v bytes are queued for the association, the datagram is dropped", streamQueueLimit))
+	}
+	if isData(msgType) && s.queued >= streamDropLimit {
+		dto.Release(frame)
+		return false, dto.NewError(dto.ErrorCode_GENERAL_FAILURE,
+			fmt.Sprintf("Over %v bytes are queued for the connection which is not read fast enough", streamDropLimit))
+	}
+	this.queue(s, msgType, frame)
+	if isData(msgType) && msgType != dto.Type_UDP_DATAGRAM && !s.paused && s.queued >= streamQueueLimit {
+		s.paused = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// OnResume sets the callback which resumes the sender of a connection paused by Offer, once its frames are written
+func (this *Scheduler) OnResume(resume func(connectionID int64)) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.onResume = resume
+}
+
+func (this *Scheduler) queue(s *stream, msgType dto.Type, frame []byte) {
+	now := time.Now()
+	s.recent = s.recent*math.Exp(-float64(now.Sub(s.lastActive))/float64(recentWindow)) + float64(len(frame))
+	s.lastActive = now
+	s.lastFinish = math.Max(this.virtualTime, s.lastFinish) + float64(len(frame))/float64(s.currentWeight())
+	s.frames = append(s.frames, queuedFrame{frame, s.lastFinish})
+	s.queued += len(frame)
+	if endsConnection(msgType) {
+		s.done = true
+	}
+	if s.index < 0 {
+		heap.Push(&this.backlog, s)
+	}
+
+	select {
+	case this.ready <- struct{}{}:
+	default:
+	}
+	this.sweep(now)
+}
+
+// Ready is signaled when frames are queued, and closed with the scheduler
+func (this *Scheduler) Ready() <-chan struct{} {
+	return this.ready
+}
+
+// Pop returns the frame to write next, nil if none is queued. more is false once the scheduler is closed
+func (this *Scheduler) Pop() (frame []byte, more bool) {
+	this.mutex.Lock()
+
+	if this.closed {
+		this.mutex.Unlock()
+		return nil, false
+	}
+	if len(this.backlog) == 0 {
+		this.mutex.Unlock()
+		return nil, true
+	}
+
+	s := this.backlog[0]
+	next := s.frames[0]
+	s.frames[0] = queuedFrame{}
+	s.frames = s.frames[1:]
+	s.queued -= len(next.data)
+	this.virtualTime = next.finish
+	if len(s.frames) > 0 {
+		heap.Fix(&this.backlog, 0)
+	} else {
+		heap.Pop(&this.backlog)
+		s.frames = nil
+		if s.done && s.waiting == 0 {
+			delete(this.streams, s.connectionID)
+		}
+	}
+	if s.waiting > 0 && s.queued < streamQueueLimit {
+		this.cond.Broadcast()
+	}
+	resume := s.paused && s.queued <= streamResumeLevel && this.onResume != nil
+	if resume {
+		s.paused = false
+	}
+	onResume := this.onResume
+	this.mutex.Unlock()
+
+	if resume { // outside the lock, the callback queues to another scheduler
+		onResume(s.connectionID)
+	}
+	return next.data, true
+}
+
+// Forget drops what is known about the connection once its frames are written
+func (this *Scheduler) Forget(connectionID int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	s := this.streams[connectionID]
+	if s == nil {
+		return
+	}
+	if len(s.frames) == 0 && s.waiting == 0 {
+		delete(this.streams, connectionID)
+	} else {
+		s.done = true
+	}
+}
+
+// sweep forgets the connections which have been idle for long, in case their end was not seen
+func (this *Scheduler) sweep(now time.Time) {
+	if now.Sub(this.lastSweep) < streamIdleTimeout {
+		return
+	}
+	this.lastSweep = now
+	for connectionID, s := range this.streams {
+		if len(s.frames) == 0 && s.waiting == 0 && now.Sub(s.lastActive) > streamIdleTimeout {
+			delete(this.streams, connectionID)
+		}
+	}
+}
+
+// Close discards the frames queued, and wakes up the writers waiting
+func (this *Scheduler) Close() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !this.closed {
+		this.closed = true
+		close(this.ready)
+		this.cond.Broadcast()
+	}
+}
+
+// streamHeap orders the streams by the finish tag of their first frame
+type streamHeap []*stream
+
+func (this streamHeap) Len() int {
+	return len(this)
+}
+
+func (this streamHeap) Less(i, j int) bool {
+	return this[i].frames[0].finish < this[j].frames[0].finish
+}
+
+func (this streamHeap) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+	this[i].index = i
+	this[j].index = j
+}
+
+func (this *streamHeap) Push(x interface{}) {
+	s := x.(*stream)
+	s.index = len(*this)
+	*this = append(*this, s)
+}
+
+func (this *streamHeap) Pop() interface{} {
+	old := *this
+	s := old[len(old)-1]
+	old[len(old)-1] = nil
+	s.index = -1
+	*this = old[:len(old)-1]
+	return s
+}
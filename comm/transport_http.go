@@ -140,8 +140,14 @@ func (this *HttpTransport) outbound() {
 				{
 					if more {
 
-						// then send the chunk data
-						_, err := writer.Write(bytes)
+						// then send the chunk data, whose length prefix is read as the legacy header on the other end
+						bytes, err := dto.ForVersion(bytes, dto.LegacyHeader)
+						if err != nil {
+							log.Println(err)
+							continue
+						}
+						_, err = writer.Write(bytes)
+						dto.Release(bytes)
 						if err != nil {
 							if this.running {
 								log.Println("The outbound goroutine exited because an error occurs :", err)
@@ -6,33 +6,42 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
+	"../config"
 	"../dto"
 
 	"github.com/gorilla/websocket"
 )
 
 type WebSocketTransport struct {
-	uri             *url.URL
-	running         bool // this flag tells goroutine if it should exits
-	outboundChannel chan []byte
-	channels        map[int64]chan dto.Message
-	mutex           sync.RWMutex
-	lastDialError   string
+	uri           *url.URL
+	running       bool       // this flag tells goroutine if it should exits
+	scheduler     *Scheduler // the frames to write
+	channels      map[int64]chan dto.Message
+	mutex         sync.RWMutex
+	lastDialError string
+	batching      config.Batching
 }
 
-func NewWebSocketTransport(uri string) (Transport, error) {
+func NewWebSocketTransport(uri string, batching config.Batching, scheduling config.Scheduling) (Transport, error) {
 	this := new(WebSocketTransport)
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
 
+	// announce the latest version of the frame headers and that batches are accepted, the broker replies likewise
+	query := u.Query()
+	query.Set(dto.VersionParam, strconv.Itoa(dto.HeaderVersion))
+	query.Set(dto.BatchParam, "1")
+	u.RawQuery = query.Encode()
 	this.uri = u
+	this.batching = batching
 	this.running = true
-	this.outboundChannel = make(chan []byte, 10)
+	this.scheduler = NewScheduler(scheduling)
 	this.channels = make(map[int64]chan dto.Message)
 	this.mutex = sync.RWMutex{}
 
@@ -42,7 +51,7 @@ func NewWebSocketTransport(uri string) (Transport, error) {
 }
 
 func (this *WebSocketTransport) Stop() {
-	close(this.outboundChannel)
+	this.scheduler.Close()
 	this.running = false
 }
 
@@ -85,10 +94,70 @@ func (this *WebSocketTransport) Write(msgType dto.Type, connectionID int64, payl
 		return err
 	}
 
-	this.outboundChannel <- bytes
+	if payload != nil && (msgType == dto.Type_TCP_CONNECT || msgType == dto.Type_UDP_ASSOCIATE || msgType == dto.Type_DNS_QUERY) {
+		this.scheduler.Classify(connectionID, payload.Address, int(payload.Port))
+	}
+	return this.scheduler.Push(connectionID, msgType, bytes)
+}
+
+// dispatch delivers the message in the frame to the channel of its connection.
+// The data of the message is sliced from the shared frame, the one consuming it releases the message
+func (this *WebSocketTransport) dispatch(frame []byte, shared *dto.SharedFrame) error {
+	msg, err := dto.DecodeShared(frame, shared)
+	if err != nil {
+		return err
+	}
+	switch msg.Header.Type {
+	case dto.Type_TCP_CONNECT, dto.Type_UDP_ASSOCIATE, dto.Type_DNS_QUERY:
+		this.scheduler.Classify(msg.Header.ConnectionID, msg.Payload.Address, int(msg.Payload.Port))
+	case dto.Type_TCP_CONNECTION_FAILED, dto.Type_TCP_CONNECTION_CLOSED:
+		this.scheduler.Forget(msg.Header.ConnectionID)
+	}
+	this.deliver(*msg)
 	return nil
 }
 
+func (this *WebSocketTransport) deliver(msg dto.Message) {
+	channel := this.getChannel(msg.Header.ConnectionID) // find the channel by connection id
+	if channel == nil {
+		channel = this.getChannel(0) // get the channel of connection id zero. which is defined as default
+	}
+	if channel != nil {
+		channel <- msg
+	}
+}
+
+// failUnsent tells the connections whose frames are lost with the websocket that they are closed, as the broker
+// closes the connections of a node which disconnects. A connection which has not been replied to fails instead
+func (this *WebSocketTransport) failUnsent(headers []*dto.MessageHeader) {
+	lost := make(map[int64]dto.Type)
+	ended := make(map[int64]bool) // closed on this end already
+	for _, header := range headers {
+		switch connectionID := header.ConnectionID; {
+		case endsConnection(header.Type):
+			ended[connectionID] = true
+		case isRequest(header.Type):
+			lost[connectionID] = dto.Type_TCP_CONNECTION_FAILED
+		case lost[connectionID] != dto.Type_TCP_CONNECTION_FAILED:
+			lost[connectionID] = dto.Type_TCP_CONNECTION_CLOSED
+		}
+	}
+	for connectionID, msgType := range lost {
+		if connectionID == 0 || ended[connectionID] {
+			continue
+		}
+		log.Println("Connection", connectionID, "is lost with the broker")
+		this.scheduler.Forget(connectionID)
+		this.deliver(dto.Message{
+			Header: &dto.MessageHeader{Type: msgType, ConnectionID: connectionID},
+			Payload: &dto.Payload{
+				ErrorCode:    dto.ErrorCode_CONNECTION_NOT_FOUND,
+				ErrorMessage: "The connection to the broker is lost",
+			},
+		})
+	}
+}
+
 func (this *WebSocketTransport) inbound() {
 
 	if !this.running {
@@ -107,7 +176,7 @@ func (this *WebSocketTransport) inbound() {
 		EnableCompression: true,
 		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
 	}
-	wsConn, _, err := dialer.Dial(this.uri.String(), httpHeader)
+	wsConn, resp, err := dialer.Dial(this.uri.String(), httpHeader)
 	if err != nil {
 		if this.lastDialError != err.Error() { // avoid duplicate errors
 			log.Println(err)
@@ -119,29 +188,70 @@ func (this *WebSocketTransport) inbound() {
 		log.Println("Connected to", this.uri)
 	}
 	defer wsConn.Close()
+	version := dto.NegotiateVersion(resp.Header.Get(dto.VersionHeader)) // brokers which do not reply one only speak the legacy header
+
+	// small messages are coalesced if the broker accepts batches
+	maxBatchSize := 0
+	if resp.Header.Get(dto.BatchHeader) == "1" {
+		maxBatchSize = this.batching.MaxSize
+	}
+	batcher := dto.NewBatcher(maxBatchSize, this.batching.GetFlushDelay(), func(bytes []byte) error {
+		err := wsConn.WriteMessage(websocket.BinaryMessage, bytes)
+		dto.Release(bytes)
+		return err
+	})
 
 	readerExitedChannel := make(chan bool)
 	exited := false
 	go (func() {
-		defer (func() { exited = true })()
+		var unsent []*dto.MessageHeader // of the frames given to the batcher, which are not written yet
+		written := func() { unsent = append(unsent[:0], unsent[len(unsent)-batcher.Held():]...) }
+		defer (func() {
+			exited = true
+			batcher.Discard()
+			this.failUnsent(unsent)
+		})()
 
 		for this.running && !exited {
 
 			select {
-			case bytes, more := <-this.outboundChannel:
+			case <-this.scheduler.Ready():
 				{
-					if more {
-						// then send the chunk data
-						err := wsConn.WriteMessage(websocket.BinaryMessage, bytes)
+					// then send the chunk data in the order the scheduler picks
+					for {
+						bytes, more := this.scheduler.Pop()
+						if !more {
+							log.Println("Writer goroutine exited because the transport was stopped")
+							return
+						}
+						if bytes == nil {
+							break
+						}
+						bytes, err := dto.ForVersion(bytes, version)
+						if err != nil {
+							log.Println(err)
+							continue
+						}
+						if header, err := dto.DecodeHeader(bytes); err == nil {
+							unsent = append(unsent, header)
+						}
+						err = batcher.Write(bytes)
 						if err != nil {
 							log.Println(err)
 							return
 						}
-					} else {
-						log.Println("Writer goroutine exited because outboundChannel was closed")
-						return // channel is closed
+						written()
 					}
 				} // case end
+			case <-batcher.Deadline():
+				{
+					err := batcher.Flush()
+					if err != nil {
+						log.Println(err)
+						return
+					}
+					written()
+				} // case end
 			case <-readerExitedChannel:
 				{
 					log.Println("Writer goroutine exited")
@@ -168,24 +278,28 @@ func (this *WebSocketTransport) inbound() {
 			break
 		}
 
-		mt, buffer, err := wsConn.ReadMessage()
+		mt, reader, err := wsConn.NextReader()
 		if err != nil {
 			log.Println(err)
 			break
 		}
 
 		if mt == websocket.BinaryMessage {
-			msg, err := dto.Decode(buffer)
+			buffer, err := dto.ReadFrame(reader)
 			if err != nil {
 				log.Println(err)
 				break
 			}
-			channel := this.getChannel(msg.Header.ConnectionID) // find the channel by connection id
-			if channel == nil {
-				channel = this.getChannel(0) // get the channel of connection id zero. which is defined as default
+			shared := dto.NewSharedFrame(buffer)
+			if dto.IsBatch(buffer) {
+				err = dto.Unbatch(buffer, func(frame []byte) error { return this.dispatch(frame, shared) })
+			} else {
+				err = this.dispatch(buffer, shared)
 			}
-			if channel != nil {
-				channel <- *msg
+			shared.Release()
+			if err != nil {
+				log.Println(err)
+				break
 			}
 		}
 	}
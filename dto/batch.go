@@ -0,0 +1,127 @@
+package dto
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// A batch is a websocket frame which starts with 0xFF, followed by frames each prefixed with its length as an uvarint.
+// Each node announces it accepts batches when connecting the broker, which announces it in the reply
+const (
+	BatchParam  = "batch"        // query parameter of the websocket URL a node announces it accepts batches with
+	BatchHeader = "Detour-Batch" // HTTP header of the upgrade response the broker announces it accepts batches with
+
+	batchMarker = 0xFF
+)
+
+func IsBatch(b []byte) bool {
+	return len(b) > 0 && b[0] == batchMarker
+}
+
+// Unbatch calls handle with each frame of the batch, which is sliced from b
+func Unbatch(b []byte, handle func([]byte) error) error {
+	b = b[1:]
+	for len(b) > 0 {
+		length, n := binary.Uvarint(b)
+		if n <= 0 || length > uint64(len(b)-n) {
+			return errors.New("Insufficient buffer to unbatch")
+		}
+		if err := handle(b[n : n+int(length)]); err != nil {
+			return err
+		}
+		b = b[n+int(length):]
+	}
+	return nil
+}
+
+// Batcher writes the frames to a peer, the small ones are held until the batch is full or the flush delay elapses.
+// The frames are released once written, write() releases what it is given
+type Batcher struct {
+	maxSize    int // zero if the frames are written as they come
+	flushDelay time.Duration
+	write      func([]byte) error
+	frames     [][]byte
+	size       int // bytes of the batch
+	deadline   <-chan time.Time
+}
+
+func NewBatcher(maxSize int, flushDelay time.Duration, write func([]byte) error) *Batcher {
+	return &Batcher{
+		maxSize:    maxSize,
+		flushDelay: flushDelay,
+		write:      write,
+	}
+}
+
+func batchedSize(b []byte) int {
+	var prefix [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(prefix[:], uint64(len(b))) + len(b)
+}
+
+func (this *Batcher) Write(b []byte) error {
+	size := batchedSize(b)
+	if 1+size > this.maxSize {
+		if err := this.Flush(); err != nil {
+			Release(b)
+			return err
+		}
+		return this.write(b)
+	}
+
+	if this.size+size > this.maxSize {
+		if err := this.Flush(); err != nil {
+			Release(b)
+			return err
+		}
+	}
+	if len(this.frames) == 0 {
+		this.size = 1
+		this.deadline = time.After(this.flushDelay)
+	}
+	this.frames = append(this.frames, b)
+	this.size += size
+	return nil
+}
+
+// Deadline is when the frames held must be flushed, nil if none is held
+func (this *Batcher) Deadline() <-chan time.Time {
+	return this.deadline
+}
+
+// Flush writes the frames held, a single frame is written as it is
+func (this *Batcher) Flush() error {
+	frames := this.frames
+	this.frames = this.frames[:0]
+	this.deadline = nil
+	switch len(frames) {
+	case 0:
+		return nil
+	case 1:
+		return this.write(frames[0])
+	}
+
+	var prefix [binary.MaxVarintLen64]byte
+	batch := append(GetBuffer(this.size), batchMarker)
+	for _, frame := range frames {
+		n := binary.PutUvarint(prefix[:], uint64(len(frame)))
+		batch = append(batch, prefix[:n]...)
+		batch = append(batch, frame...)
+		Release(frame)
+	}
+	return this.write(batch)
+}
+
+// Held returns the number of frames held, which are the last ones given to Write
+func (this *Batcher) Held() int {
+	return len(this.frames)
+}
+
+// Discard releases the frames held without writing them, once the peer is gone
+func (this *Batcher) Discard() {
+	for _, frame := range this.frames {
+		Release(frame)
+	}
+	this.frames = this.frames[:0]
+	this.deadline = nil
+}
@@ -38,16 +38,36 @@ const (
 	Type_TCP_CONNECTION_CLOSED      Type = 4
 	Type_INBOUND_DATA               Type = 5
 	Type_OUTBOUND_DATA              Type = 6
+	Type_DNS_QUERY                  Type = 7
+	Type_DNS_RESPONSE               Type = 8
+	Type_UDP_ASSOCIATE              Type = 9
+	Type_UDP_DATAGRAM               Type = 10
+	Type_TCP_BIND                   Type = 11
+	Type_TCP_BOUND                  Type = 12
+	Type_REVERSE_LISTEN             Type = 13
+	Type_REVERSE_CONNECT            Type = 14
+	Type_FLOW_PAUSE                 Type = 15
+	Type_FLOW_RESUME                Type = 16
 )
 
 var Type_name = map[int32]string{
-	0: "UNSPECIFIC",
-	1: "TCP_CONNECT",
-	2: "TCP_CONNECTION_ESTABLISHED",
-	3: "TCP_CONNECTION_FAILED",
-	4: "TCP_CONNECTION_CLOSED",
-	5: "INBOUND_DATA",
-	6: "OUTBOUND_DATA",
+	0:  "UNSPECIFIC",
+	1:  "TCP_CONNECT",
+	2:  "TCP_CONNECTION_ESTABLISHED",
+	3:  "TCP_CONNECTION_FAILED",
+	4:  "TCP_CONNECTION_CLOSED",
+	5:  "INBOUND_DATA",
+	6:  "OUTBOUND_DATA",
+	7:  "DNS_QUERY",
+	8:  "DNS_RESPONSE",
+	9:  "UDP_ASSOCIATE",
+	10: "UDP_DATAGRAM",
+	11: "TCP_BIND",
+	12: "TCP_BOUND",
+	13: "REVERSE_LISTEN",
+	14: "REVERSE_CONNECT",
+	15: "FLOW_PAUSE",
+	16: "FLOW_RESUME",
 }
 var Type_value = map[string]int32{
 	"UNSPECIFIC":                 0,
@@ -57,6 +77,16 @@ var Type_value = map[string]int32{
 	"TCP_CONNECTION_CLOSED":      4,
 	"INBOUND_DATA":               5,
 	"OUTBOUND_DATA":              6,
+	"DNS_QUERY":                  7,
+	"DNS_RESPONSE":               8,
+	"UDP_ASSOCIATE":              9,
+	"UDP_DATAGRAM":               10,
+	"TCP_BIND":                   11,
+	"TCP_BOUND":                  12,
+	"REVERSE_LISTEN":             13,
+	"REVERSE_CONNECT":            14,
+	"FLOW_PAUSE":                 15,
+	"FLOW_RESUME":                16,
 }
 
 func (x Type) String() string {
@@ -64,6 +94,54 @@ func (x Type) String() string {
 }
 func (Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
 
+type ErrorCode int32
+
+const (
+	ErrorCode_NO_ERROR             ErrorCode = 0
+	ErrorCode_GENERAL_FAILURE      ErrorCode = 1
+	ErrorCode_CONNECTION_REFUSED   ErrorCode = 2
+	ErrorCode_NAME_NOT_RESOLVED    ErrorCode = 3
+	ErrorCode_HOST_UNREACHABLE     ErrorCode = 4
+	ErrorCode_NETWORK_UNREACHABLE  ErrorCode = 5
+	ErrorCode_TIMEOUT              ErrorCode = 6
+	ErrorCode_NO_SERVER_AVAILABLE  ErrorCode = 7
+	ErrorCode_NOT_ALLOWED          ErrorCode = 8
+	ErrorCode_CONNECTION_NOT_FOUND ErrorCode = 9
+	ErrorCode_SERVER_BUSY          ErrorCode = 10
+)
+
+var ErrorCode_name = map[int32]string{
+	0:  "NO_ERROR",
+	1:  "GENERAL_FAILURE",
+	2:  "CONNECTION_REFUSED",
+	3:  "NAME_NOT_RESOLVED",
+	4:  "HOST_UNREACHABLE",
+	5:  "NETWORK_UNREACHABLE",
+	6:  "TIMEOUT",
+	7:  "NO_SERVER_AVAILABLE",
+	8:  "NOT_ALLOWED",
+	9:  "CONNECTION_NOT_FOUND",
+	10: "SERVER_BUSY",
+}
+var ErrorCode_value = map[string]int32{
+	"NO_ERROR":             0,
+	"GENERAL_FAILURE":      1,
+	"CONNECTION_REFUSED":   2,
+	"NAME_NOT_RESOLVED":    3,
+	"HOST_UNREACHABLE":     4,
+	"NETWORK_UNREACHABLE":  5,
+	"TIMEOUT":              6,
+	"NO_SERVER_AVAILABLE":  7,
+	"NOT_ALLOWED":          8,
+	"CONNECTION_NOT_FOUND": 9,
+	"SERVER_BUSY":          10,
+}
+
+func (x ErrorCode) String() string {
+	return proto.EnumName(ErrorCode_name, int32(x))
+}
+func (ErrorCode) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
 type Mode int32
 
 const (
@@ -83,7 +161,7 @@ var Mode_value = map[string]int32{
 func (x Mode) String() string {
 	return proto.EnumName(Mode_name, int32(x))
 }
-func (Mode) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+func (Mode) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
 
 type MessageHeader struct {
 	Type         Type  `protobuf:"varint,1,opt,name=type,enum=dto.Type" json:"type,omitempty"`
@@ -126,10 +204,14 @@ func (m *MessageHeader) GetLength() int32 {
 }
 
 type Payload struct {
-	Address      string `protobuf:"bytes,1,opt,name=address" json:"address,omitempty"`
-	Port         int32  `protobuf:"varint,2,opt,name=port" json:"port,omitempty"`
-	Data         []byte `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
-	ErrorMessage string `protobuf:"bytes,4,opt,name=errorMessage" json:"errorMessage,omitempty"`
+	Address       string    `protobuf:"bytes,1,opt,name=address" json:"address,omitempty"`
+	Port          int32     `protobuf:"varint,2,opt,name=port" json:"port,omitempty"`
+	Data          []byte    `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	ErrorMessage  string    `protobuf:"bytes,4,opt,name=errorMessage" json:"errorMessage,omitempty"`
+	ErrorCode     ErrorCode `protobuf:"varint,5,opt,name=errorCode,enum=dto.ErrorCode" json:"errorCode,omitempty"`
+	ListenerID    int64     `protobuf:"varint,6,opt,name=listenerID" json:"listenerID,omitempty"`
+	SourceNode    string    `protobuf:"bytes,7,opt,name=sourceNode" json:"sourceNode,omitempty"`
+	SourceAddress string    `protobuf:"bytes,8,opt,name=sourceAddress" json:"sourceAddress,omitempty"`
 }
 
 func (m *Payload) Reset()                    { *m = Payload{} }
@@ -165,38 +247,85 @@ func (m *Payload) GetErrorMessage() string {
 	return ""
 }
 
+func (m *Payload) GetErrorCode() ErrorCode {
+	if m != nil {
+		return m.ErrorCode
+	}
+	return ErrorCode_NO_ERROR
+}
+
+func (m *Payload) GetListenerID() int64 {
+	if m != nil {
+		return m.ListenerID
+	}
+	return 0
+}
+
+func (m *Payload) GetSourceNode() string {
+	if m != nil {
+		return m.SourceNode
+	}
+	return ""
+}
+
+func (m *Payload) GetSourceAddress() string {
+	if m != nil {
+		return m.SourceAddress
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*MessageHeader)(nil), "dto.MessageHeader")
 	proto.RegisterType((*Payload)(nil), "dto.Payload")
 	proto.RegisterEnum("dto.Type", Type_name, Type_value)
+	proto.RegisterEnum("dto.ErrorCode", ErrorCode_name, ErrorCode_value)
 	proto.RegisterEnum("dto.Mode", Mode_name, Mode_value)
 }
 
 func init() { proto.RegisterFile("dto.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 359 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x91, 0xc1, 0x8e, 0xd3, 0x30,
-	0x10, 0x86, 0xd7, 0x4d, 0xd2, 0x25, 0x43, 0x77, 0xd7, 0x8c, 0x04, 0x0a, 0x20, 0x50, 0xd5, 0x53,
-	0xb5, 0x87, 0x1e, 0xe0, 0x09, 0xd2, 0xd8, 0xd5, 0x46, 0xca, 0x3a, 0x91, 0x93, 0x5e, 0xb8, 0x54,
-	0x61, 0x6d, 0x2d, 0x48, 0x4b, 0x1c, 0x39, 0x46, 0x22, 0x8f, 0xc0, 0x6b, 0x70, 0xe4, 0x29, 0x51,
-	0xac, 0x22, 0xb5, 0x88, 0xdb, 0xcc, 0x37, 0xf2, 0xfc, 0xff, 0xef, 0x81, 0x58, 0x39, 0xb3, 0xe9,
-	0xad, 0x71, 0x06, 0x03, 0xe5, 0xcc, 0xea, 0x27, 0x81, 0xab, 0x7b, 0x3d, 0x0c, 0xed, 0xa3, 0xbe,
-	0xd3, 0xad, 0xd2, 0x16, 0xdf, 0x41, 0xe8, 0xc6, 0x5e, 0x27, 0x64, 0x49, 0xd6, 0xd7, 0x1f, 0xe2,
-	0xcd, 0xf4, 0xa0, 0x19, 0x7b, 0x2d, 0x3d, 0xc6, 0x15, 0x2c, 0x1e, 0x4c, 0xd7, 0xe9, 0x07, 0xf7,
-	0xd5, 0x74, 0x39, 0x4b, 0x66, 0x4b, 0xb2, 0x0e, 0xe4, 0x19, 0x9b, 0x56, 0x7c, 0x33, 0x4a, 0x27,
-	0xc1, 0xc9, 0x8a, 0x7b, 0xa3, 0xb4, 0xf4, 0x18, 0x5f, 0xc1, 0xfc, 0x49, 0x77, 0x8f, 0xee, 0x4b,
-	0x12, 0x2e, 0xc9, 0x3a, 0x92, 0xc7, 0x6e, 0x65, 0xe0, 0xb2, 0x6a, 0xc7, 0x27, 0xd3, 0x2a, 0x4c,
-	0xe0, 0xb2, 0x55, 0xca, 0xea, 0x61, 0xf0, 0x3e, 0x62, 0xf9, 0xb7, 0x45, 0x84, 0xb0, 0x37, 0xd6,
-	0x79, 0xdd, 0x48, 0xfa, 0x7a, 0x62, 0xaa, 0x75, 0xad, 0xd7, 0x5b, 0x48, 0x5f, 0x4f, 0x3e, 0xb5,
-	0xb5, 0xc6, 0x1e, 0xc3, 0x79, 0xa9, 0x58, 0x9e, 0xb1, 0xdb, 0x5f, 0x04, 0xc2, 0x29, 0x1a, 0x5e,
-	0x03, 0xec, 0x45, 0x5d, 0xf1, 0x2c, 0xdf, 0xe5, 0x19, 0xbd, 0xc0, 0x1b, 0x78, 0xde, 0x64, 0xd5,
-	0x21, 0x2b, 0x85, 0xe0, 0x59, 0x43, 0x09, 0xbe, 0x87, 0x37, 0x27, 0x20, 0x2f, 0xc5, 0x81, 0xd7,
-	0x4d, 0xba, 0x2d, 0xf2, 0xfa, 0x8e, 0x33, 0x3a, 0xc3, 0xd7, 0xf0, 0xf2, 0x9f, 0xf9, 0x2e, 0xcd,
-	0x0b, 0xce, 0x68, 0xf0, 0x9f, 0x51, 0x56, 0x94, 0x35, 0x67, 0x34, 0x44, 0x0a, 0x8b, 0x5c, 0x6c,
-	0xcb, 0xbd, 0x60, 0x07, 0x96, 0x36, 0x29, 0x8d, 0xf0, 0x05, 0x5c, 0x95, 0xfb, 0xe6, 0x04, 0xcd,
-	0x6f, 0xdf, 0x42, 0x38, 0xfd, 0x1d, 0x3e, 0x83, 0x50, 0x94, 0x82, 0xd3, 0x0b, 0x8c, 0x21, 0x2a,
-	0x3e, 0xed, 0x6a, 0x4e, 0xc9, 0x16, 0x7f, 0xcf, 0x6e, 0x98, 0x76, 0xe6, 0xbb, 0xad, 0xac, 0xf9,
-	0x31, 0x6e, 0x58, 0x53, 0x7e, 0x9e, 0xfb, 0xf3, 0x7e, 0xfc, 0x13, 0x00, 0x00, 0xff, 0xff, 0x5d,
-	0x7c, 0xb3, 0x3a, 0xeb, 0x01, 0x00, 0x00,
+	// 655 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x54, 0xcd, 0x6e, 0xd3, 0x4c,
+	0x14, 0xad, 0x13, 0xe7, 0xc7, 0xb7, 0xf9, 0x99, 0x4e, 0x7f, 0xbe, 0x7c, 0x20, 0xaa, 0xaa, 0x62,
+	0x51, 0x55, 0xa8, 0x0b, 0x78, 0x82, 0x89, 0x7d, 0xd3, 0x58, 0x38, 0x33, 0x61, 0xc6, 0x4e, 0x55,
+	0x36, 0x56, 0xa8, 0x47, 0xa5, 0x52, 0x89, 0x23, 0xc7, 0x95, 0xc8, 0x9a, 0x15, 0xaf, 0xc2, 0xcb,
+	0xf0, 0x26, 0x3c, 0x03, 0x9a, 0x21, 0x01, 0x07, 0xb1, 0x9b, 0x73, 0xee, 0x9d, 0x73, 0xce, 0x9c,
+	0x28, 0x06, 0x2f, 0x2b, 0xf3, 0xab, 0x65, 0x91, 0x97, 0x39, 0xad, 0x67, 0x65, 0x7e, 0xfe, 0xd5,
+	0x81, 0xee, 0x44, 0xaf, 0x56, 0xf3, 0x7b, 0x3d, 0xd6, 0xf3, 0x4c, 0x17, 0xf4, 0x05, 0xb8, 0xe5,
+	0x7a, 0xa9, 0x07, 0xce, 0x99, 0x73, 0xd1, 0x7b, 0xed, 0x5d, 0x99, 0x0b, 0xf1, 0x7a, 0xa9, 0xa5,
+	0xa5, 0xe9, 0x39, 0x74, 0xee, 0xf2, 0xc5, 0x42, 0xdf, 0x95, 0x0f, 0xf9, 0x22, 0x0c, 0x06, 0xb5,
+	0x33, 0xe7, 0xa2, 0x2e, 0x77, 0x38, 0x23, 0xf1, 0x29, 0xcf, 0xf4, 0xa0, 0x5e, 0x91, 0x98, 0xe4,
+	0x99, 0x96, 0x96, 0xa6, 0x27, 0xd0, 0x7c, 0xd4, 0x8b, 0xfb, 0xf2, 0xe3, 0xc0, 0x3d, 0x73, 0x2e,
+	0x1a, 0x72, 0x83, 0xce, 0xbf, 0xd4, 0xa0, 0x35, 0x9d, 0xaf, 0x1f, 0xf3, 0x79, 0x46, 0x07, 0xd0,
+	0x9a, 0x67, 0x59, 0xa1, 0x57, 0x2b, 0x1b, 0xc4, 0x93, 0x5b, 0x48, 0x29, 0xb8, 0xcb, 0xbc, 0x28,
+	0xad, 0x71, 0x43, 0xda, 0xb3, 0xe1, 0xb2, 0x79, 0x39, 0xb7, 0x86, 0x1d, 0x69, 0xcf, 0x26, 0xa8,
+	0x2e, 0x8a, 0xbc, 0xd8, 0xbc, 0xce, 0x7a, 0x79, 0x72, 0x87, 0xa3, 0xaf, 0xc0, 0xb3, 0xd8, 0x37,
+	0x69, 0x1b, 0x36, 0x6d, 0xcf, 0xa6, 0xc5, 0x2d, 0x2b, 0xff, 0x2c, 0xd0, 0x53, 0x80, 0xc7, 0x87,
+	0x55, 0xa9, 0x17, 0xba, 0x08, 0x83, 0x41, 0xd3, 0x3e, 0xbc, 0xc2, 0x98, 0xf9, 0x2a, 0x7f, 0x2a,
+	0xee, 0x34, 0x37, 0x72, 0x2d, 0xeb, 0x57, 0x61, 0xe8, 0x4b, 0xe8, 0xfe, 0x42, 0x6c, 0xf3, 0xb2,
+	0xb6, 0x5d, 0xd9, 0x25, 0x2f, 0xbf, 0xd7, 0xc0, 0x35, 0x7d, 0xd3, 0x1e, 0x40, 0xc2, 0xd5, 0x14,
+	0xfd, 0x70, 0x14, 0xfa, 0x64, 0x8f, 0xf6, 0x61, 0x3f, 0xf6, 0xa7, 0xa9, 0x2f, 0x38, 0x47, 0x3f,
+	0x26, 0x0e, 0x3d, 0x85, 0x67, 0x15, 0x22, 0x14, 0x3c, 0x45, 0x15, 0xb3, 0x61, 0x14, 0xaa, 0x31,
+	0x06, 0xa4, 0x46, 0xff, 0x87, 0xe3, 0xbf, 0xe6, 0x23, 0x16, 0x46, 0x18, 0x90, 0xfa, 0x3f, 0x46,
+	0x7e, 0x24, 0x14, 0x06, 0xc4, 0xa5, 0x04, 0x3a, 0x21, 0x1f, 0x8a, 0x84, 0x07, 0x69, 0xc0, 0x62,
+	0x46, 0x1a, 0xf4, 0x00, 0xba, 0x22, 0x89, 0x2b, 0x54, 0x93, 0x76, 0xc1, 0x0b, 0xb8, 0x4a, 0xdf,
+	0x25, 0x28, 0x6f, 0x49, 0xcb, 0xdc, 0x31, 0x50, 0xa2, 0x9a, 0x0a, 0xae, 0x90, 0xb4, 0xcd, 0x9d,
+	0x24, 0x98, 0xa6, 0x4c, 0x29, 0xe1, 0x87, 0x2c, 0x46, 0xe2, 0x99, 0x25, 0x43, 0x19, 0x85, 0x6b,
+	0xc9, 0x26, 0x04, 0x68, 0x07, 0xda, 0x26, 0xc5, 0x30, 0xe4, 0x01, 0xd9, 0x37, 0x9a, 0x16, 0x19,
+	0x1f, 0xd2, 0xa1, 0x14, 0x7a, 0x12, 0x67, 0x28, 0x15, 0xa6, 0x51, 0xa8, 0x62, 0xe4, 0xa4, 0x4b,
+	0x0f, 0xa1, 0xbf, 0xe5, 0xb6, 0x35, 0xf4, 0x4c, 0x4f, 0xa3, 0x48, 0xdc, 0xa4, 0x53, 0x96, 0x28,
+	0x24, 0x7d, 0xd3, 0x93, 0xc5, 0x12, 0x55, 0x32, 0x41, 0x42, 0x2e, 0x7f, 0x38, 0xe0, 0xfd, 0xfe,
+	0x41, 0x8d, 0x29, 0x17, 0x29, 0x4a, 0x29, 0x24, 0xd9, 0x33, 0x8a, 0xd7, 0xc8, 0x51, 0xb2, 0xc8,
+	0x96, 0x93, 0x48, 0x24, 0x0e, 0x3d, 0x01, 0x5a, 0x69, 0x46, 0xe2, 0x28, 0x51, 0xb6, 0xd0, 0x63,
+	0x38, 0xe0, 0x6c, 0x82, 0x29, 0x17, 0xb1, 0x51, 0x17, 0xd1, 0xcc, 0x96, 0x79, 0x04, 0x64, 0x2c,
+	0x54, 0x9c, 0x26, 0x5c, 0x22, 0xf3, 0xc7, 0x6c, 0x18, 0x21, 0x71, 0xe9, 0x7f, 0x70, 0xc8, 0x31,
+	0xbe, 0x11, 0xf2, 0xed, 0xce, 0xa0, 0x41, 0xf7, 0xa1, 0x15, 0x87, 0x13, 0x14, 0x49, 0x4c, 0x9a,
+	0x76, 0x4b, 0xa4, 0x0a, 0xe5, 0x0c, 0x65, 0xca, 0x66, 0x2c, 0x8c, 0xec, 0x56, 0xcb, 0xbc, 0xc2,
+	0xd8, 0xb0, 0x28, 0x12, 0x37, 0x18, 0x90, 0x36, 0x1d, 0xc0, 0x51, 0x25, 0x94, 0x99, 0x8d, 0x6c,
+	0x53, 0x9e, 0x59, 0xdd, 0x08, 0x0c, 0x13, 0x75, 0x4b, 0xe0, 0xf2, 0x39, 0xb8, 0xe6, 0xef, 0x46,
+	0xdb, 0xe0, 0x72, 0xc1, 0x91, 0xec, 0x51, 0x0f, 0x1a, 0xd1, 0xfb, 0x91, 0x42, 0xe2, 0x0c, 0xe9,
+	0xb7, 0x5a, 0x3f, 0xd0, 0x65, 0xfe, 0x54, 0x4c, 0x8b, 0xfc, 0xf3, 0xfa, 0x2a, 0x88, 0xc5, 0x87,
+	0xa6, 0xfd, 0x22, 0xbc, 0xf9, 0x39, 0x00, 0x47, 0xa2, 0x2c, 0x83, 0x1e, 0x04, 0x00, 0x00,
 }
@@ -0,0 +1,119 @@
+package dto
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Error is a failure reported by the broker or the exit server
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (this *Error) Error() string {
+	return this.Message
+}
+
+func (this *Error) Timeout() bool {
+	return this.Code == ErrorCode_TIMEOUT
+}
+
+// Temporary tells if the same request may succeed later
+func (this *Error) Temporary() bool {
+	return this.Code == ErrorCode_NO_SERVER_AVAILABLE || this.Code == ErrorCode_SERVER_BUSY || this.Code == ErrorCode_TIMEOUT
+}
+
+// NewErrorPayload carries both the code and the message of err
+func NewErrorPayload(err error) *Payload {
+	return &Payload{
+		ErrorCode:    ErrorCodeOf(err),
+		ErrorMessage: err.Error(),
+	}
+}
+
+// ErrorOf restores the error from a failure message.
+// Nodes of older versions only set the message, so the code is derived from it only if the payload has none
+func ErrorOf(payload *Payload, defaultMessage string) *Error {
+	if payload == nil || len(payload.ErrorMessage) == 0 {
+		code := ErrorCode_GENERAL_FAILURE
+		if payload != nil && payload.ErrorCode != ErrorCode_NO_ERROR {
+			code = payload.ErrorCode
+		}
+		return NewError(code, defaultMessage)
+	}
+	if payload.ErrorCode == ErrorCode_NO_ERROR {
+		return NewError(codeOfMessage(payload.ErrorMessage), payload.ErrorMessage)
+	}
+	return NewError(payload.ErrorCode, payload.ErrorMessage)
+}
+
+// ErrorCodeOf classifies the error of dialing or relaying by its type, looking through the errors it wraps
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ErrorCode_NO_ERROR
+	}
+	var dtoErr *Error
+	if errors.As(err, &dtoErr) {
+		return dtoErr.Code
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.Timeout() {
+			return ErrorCode_TIMEOUT
+		}
+		return ErrorCode_NAME_NOT_RESOLVED
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return ErrorCode_CONNECTION_REFUSED
+		case syscall.ENETUNREACH:
+			return ErrorCode_NETWORK_UNREACHABLE
+		case syscall.EHOSTUNREACH:
+			return ErrorCode_HOST_UNREACHABLE
+		case syscall.ETIMEDOUT:
+			return ErrorCode_TIMEOUT
+		case syscall.EACCES, syscall.EPERM:
+			return ErrorCode_NOT_ALLOWED
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorCode_TIMEOUT
+	}
+	return ErrorCode_GENERAL_FAILURE
+}
+
+// codeOfMessage guesses the code of a failure reported by a node of an older version, which only sets the message
+func codeOfMessage(message string) ErrorCode {
+	message = strings.ToLower(message)
+	switch {
+	case strings.Contains(message, "connection refused"):
+		return ErrorCode_CONNECTION_REFUSED
+	case strings.Contains(message, "network is unreachable"):
+		return ErrorCode_NETWORK_UNREACHABLE
+	case strings.Contains(message, "no such host"):
+		return ErrorCode_NAME_NOT_RESOLVED
+	case strings.Contains(message, "no route to host"),
+		strings.Contains(message, "host is unreachable"):
+		return ErrorCode_HOST_UNREACHABLE
+	case strings.Contains(message, "timeout"),
+		strings.Contains(message, "timed out"):
+		return ErrorCode_TIMEOUT
+	case strings.Contains(message, "permission denied"),
+		strings.Contains(message, "not allowed"):
+		return ErrorCode_NOT_ALLOWED
+	}
+	return ErrorCode_GENERAL_FAILURE
+}
@@ -0,0 +1,60 @@
+package dto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	tests := []struct {
+		name string
+		err  error
+		code ErrorCode
+	}{
+		{"nil", nil, ErrorCode_NO_ERROR},
+		{"reported", NewError(ErrorCode_SERVER_BUSY, "busy"), ErrorCode_SERVER_BUSY},
+		{"wrapped report", fmt.Errorf("relay : %w", NewError(ErrorCode_NOT_ALLOWED, "denied")), ErrorCode_NOT_ALLOWED},
+		{"refused", refused, ErrorCode_CONNECTION_REFUSED},
+		{"wrapped refused", fmt.Errorf("dial : %w", refused), ErrorCode_CONNECTION_REFUSED},
+		{"network unreachable", os.NewSyscallError("connect", syscall.ENETUNREACH), ErrorCode_NETWORK_UNREACHABLE},
+		{"host unreachable", syscall.EHOSTUNREACH, ErrorCode_HOST_UNREACHABLE},
+		{"permission", syscall.EACCES, ErrorCode_NOT_ALLOWED},
+		{"not found", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}}, ErrorCode_NAME_NOT_RESOLVED},
+		{"resolver timeout", &net.DNSError{Err: "timeout", Name: "x.test", IsTimeout: true}, ErrorCode_TIMEOUT},
+		{"deadline", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, ErrorCode_TIMEOUT},
+		{"context", context.DeadlineExceeded, ErrorCode_TIMEOUT},
+		{"message only", errors.New("connection refused"), ErrorCode_GENERAL_FAILURE},
+	}
+	for _, test := range tests {
+		if code := ErrorCodeOf(test.err); code != test.code {
+			t.Errorf("%v : got %v, want %v", test.name, code, test.code)
+		}
+	}
+}
+
+func TestErrorOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload *Payload
+		code    ErrorCode
+		message string
+	}{
+		{"no payload", nil, ErrorCode_GENERAL_FAILURE, "default"},
+		{"code only", &Payload{ErrorCode: ErrorCode_TIMEOUT}, ErrorCode_TIMEOUT, "default"},
+		{"code and message", &Payload{ErrorCode: ErrorCode_HOST_UNREACHABLE, ErrorMessage: "unreachable"}, ErrorCode_HOST_UNREACHABLE, "unreachable"},
+		{"message of an older node", &Payload{ErrorMessage: "dial tcp: connection refused"}, ErrorCode_CONNECTION_REFUSED, "dial tcp: connection refused"},
+		{"code over message", &Payload{ErrorCode: ErrorCode_GENERAL_FAILURE, ErrorMessage: "connection refused"}, ErrorCode_GENERAL_FAILURE, "connection refused"},
+	}
+	for _, test := range tests {
+		err := ErrorOf(test.payload, "default")
+		if err.Code != test.code || err.Message != test.message {
+			t.Errorf("%v : got (%v, %q), want (%v, %q)", test.name, err.Code, err.Message, test.code, test.message)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package dto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// A frame starts with the header, followed by the payload in protobuf.
+//
+// Version 0 is the protobuf MessageHeader prefixed with its length, which is always below 128.
+// Version 1 is a fixed layout of 16 bytes, which the broker parses by slicing :
+//
+//	0      0x80 | version
+//	1      type
+//	2      flags, the mode of the payload
+//	3      reserved
+//	4-11   connection ID in big endian
+//	12-15  payload length in big endian
+//
+// Each node announces the latest version it speaks when connecting the broker, which announces its own in the reply.
+// Both send the lower of the two, frames of any version are decoded
+const (
+	LegacyHeader  = 0
+	FixedHeader   = 1
+	HeaderVersion = FixedHeader // the latest version
+
+	VersionParam  = "v"                     // query parameter of the websocket URL a node announces its version with
+	VersionHeader = "Detour-Header-Version" // HTTP header of the upgrade response the broker announces its version with
+
+	versionMarker     = 0x80
+	fixedHeaderLength = 16
+)
+
+// NegotiateVersion returns the version to send to a peer which announced the version given, legacy if it announced none
+func NegotiateVersion(announced string) int {
+	version, err := strconv.Atoi(announced)
+	if err != nil || version < LegacyHeader {
+		return LegacyHeader
+	}
+	if version > HeaderVersion {
+		return HeaderVersion
+	}
+	return version
+}
+
+// FrameVersion returns the version of the header of the frame
+func FrameVersion(b []byte) int {
+	if len(b) > 0 && b[0]&versionMarker != 0 {
+		return int(b[0] &^ versionMarker)
+	}
+	return LegacyHeader
+}
+
+// frame writes the header in the version given into a pooled buffer with room for the payload
+func frame(version int, header *MessageHeader, payloadLength int) ([]byte, error) {
+	switch version {
+	case LegacyHeader:
+		header.Length = int32(payloadLength)
+		headerLength := proto.Size(header)
+		if headerLength >= versionMarker {
+			return nil, errors.New("Header length should never be greater than 127")
+		}
+		buffer := proto.NewBuffer(append(GetBuffer(1+headerLength+payloadLength), uint8(headerLength)))
+		if err := buffer.Marshal(header); err != nil {
+			Release(buffer.Bytes())
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+
+	case FixedHeader:
+		if header.Type < 0 || header.Type > 255 || header.Mode < 0 || header.Mode > 255 {
+			return nil, errors.New(fmt.Sprintf("Type %v or mode %v does not fit in the header", header.Type, header.Mode))
+		}
+		b := GetBuffer(fixedHeaderLength + payloadLength)[:fixedHeaderLength]
+		b[0] = versionMarker | FixedHeader
+		b[1] = uint8(header.Type)
+		b[2] = uint8(header.Mode)
+		b[3] = 0
+		binary.BigEndian.PutUint64(b[4:12], uint64(header.ConnectionID))
+		binary.BigEndian.PutUint32(b[12:16], uint32(payloadLength))
+		return b, nil
+
+	default:
+		return nil, errors.New(fmt.Sprintf("Header version %v is unknown", version))
+	}
+}
+
+// unframe parses the header of the frame, and slices the payload which follows
+func unframe(b []byte) (*MessageHeader, []byte, error) {
+	switch FrameVersion(b) {
+	case LegacyHeader:
+		if len(b) < 1 {
+			return nil, nil, errors.New("Insufficient buffer to decode")
+		}
+		headerLength := int(b[0])
+		if len(b) < 1+headerLength {
+			return nil, nil, errors.New("Insufficient buffer to decode")
+		}
+		header := &MessageHeader{}
+		if err := proto.Unmarshal(b[1:headerLength+1], header); err != nil {
+			return nil, nil, err
+		}
+		return header, b[headerLength+1:], nil
+
+	case FixedHeader:
+		if len(b) < fixedHeaderLength {
+			return nil, nil, errors.New("Insufficient buffer to decode")
+		}
+		header := &MessageHeader{
+			Type:         Type(b[1]),
+			Mode:         Mode(b[2]),
+			ConnectionID: int64(binary.BigEndian.Uint64(b[4:12])),
+			Length:       int32(binary.BigEndian.Uint32(b[12:16])),
+		}
+		if header.Length < 0 || int(header.Length) > len(b)-fixedHeaderLength {
+			return nil, nil, errors.New("Insufficient buffer to decode")
+		}
+		return header, b[fixedHeaderLength : fixedHeaderLength+int(header.Length)], nil
+
+	default:
+		return nil, nil, errors.New(fmt.Sprintf("Header version %v is unknown", FrameVersion(b)))
+	}
+}
+
+// ForVersion returns the frame with its header in the version given if it is newer, the payload is copied as it is.
+// The frame is released when converted
+func ForVersion(b []byte, version int) ([]byte, error) {
+	if FrameVersion(b) <= version {
+		return b, nil
+	}
+	header, payload, err := unframe(b)
+	if err != nil {
+		return nil, err
+	}
+	converted, err := frame(version, header, len(payload))
+	if err != nil {
+		return nil, err
+	}
+	converted = append(converted, payload...)
+	Release(b)
+	return converted, nil
+}
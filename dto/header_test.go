@@ -0,0 +1,137 @@
+package dto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// encodeFor frames the payload with the header in the version given
+func encodeFor(t *testing.T, version int, payload *Payload) []byte {
+	b, err := Encode(Type_OUTBOUND_DATA, 42, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = ForVersion(b, version); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestUnframe(t *testing.T) {
+	payload := &Payload{Data: []byte("payload")}
+	legacy := encodeFor(t, LegacyHeader, payload)
+	fixed := encodeFor(t, FixedHeader, payload)
+	oversized := append([]byte{}, fixed...)
+	binary.BigEndian.PutUint32(oversized[12:16], uint32(len(fixed)))
+	negative := append([]byte{}, fixed...)
+	binary.BigEndian.PutUint32(negative[12:16], 0xFFFFFFFF)
+	unknown := append([]byte{}, fixed...)
+	unknown[0] = versionMarker | 5
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		version int
+		valid   bool
+	}{
+		{"legacy", legacy, LegacyHeader, true},
+		{"v1", fixed, FixedHeader, true},
+		{"empty", []byte{}, LegacyHeader, false},
+		{"truncated legacy header", legacy[:legacy[0]], LegacyHeader, false},
+		{"truncated v1 header", fixed[:fixedHeaderLength-1], FixedHeader, false},
+		{"truncated v1 payload", fixed[:len(fixed)-1], FixedHeader, false},
+		{"oversized v1 length", oversized, FixedHeader, false},
+		{"negative v1 length", negative, FixedHeader, false},
+		{"unknown version", unknown, 5, false},
+	}
+	for _, test := range tests {
+		if version := FrameVersion(test.frame); version != test.version {
+			t.Errorf("%v : got version %v, want %v", test.name, version, test.version)
+		}
+		header, rest, err := unframe(test.frame)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%v : decoded %v", test.name, header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v : %v", test.name, err)
+			continue
+		}
+		if header.Type != Type_OUTBOUND_DATA || header.ConnectionID != 42 || int(header.Length) != len(rest) {
+			t.Errorf("%v : got header %v", test.name, header)
+		}
+		if decoded, err := unmarshalPayload(rest); err != nil || !bytes.Equal(decoded.Data, payload.Data) {
+			t.Errorf("%v : got payload %v, %v", test.name, decoded, err)
+		}
+	}
+}
+
+func TestForVersion(t *testing.T) {
+	payload := &Payload{Address: "example.com", Port: 80, Data: []byte("payload")}
+	tests := []struct {
+		name    string
+		sent    int
+		version int
+		want    int
+	}{
+		{"v1 to legacy", FixedHeader, LegacyHeader, LegacyHeader},
+		{"v1 to v1", FixedHeader, FixedHeader, FixedHeader},
+		{"legacy to legacy", LegacyHeader, LegacyHeader, LegacyHeader},
+		{"legacy is not upgraded", LegacyHeader, FixedHeader, LegacyHeader},
+	}
+	for _, test := range tests {
+		sent := encodeFor(t, test.sent, payload)
+		_, sentPayload, _ := unframe(sent)
+		sentPayload = append([]byte{}, sentPayload...)
+
+		converted, err := ForVersion(sent, test.version)
+		if err != nil {
+			t.Errorf("%v : %v", test.name, err)
+			continue
+		}
+		if version := FrameVersion(converted); version != test.want {
+			t.Errorf("%v : got version %v, want %v", test.name, version, test.want)
+		}
+		header, rest, err := unframe(converted)
+		if err != nil {
+			t.Errorf("%v : %v", test.name, err)
+			continue
+		}
+		if header.Type != Type_OUTBOUND_DATA || header.ConnectionID != 42 || header.Mode != Mode_NONE {
+			t.Errorf("%v : got header %v", test.name, header)
+		}
+		if !bytes.Equal(rest, sentPayload) {
+			t.Errorf("%v : the payload is changed", test.name)
+		}
+	}
+
+	truncated := encodeFor(t, FixedHeader, payload)
+	if _, err := ForVersion(truncated[:fixedHeaderLength+1], LegacyHeader); err == nil {
+		t.Error("a truncated frame is converted")
+	}
+	if _, err := frame(FixedHeader, &MessageHeader{Type: 256}, 0); err == nil {
+		t.Error("a type over 255 is framed in the v1 header")
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		announced string
+		version   int
+	}{
+		{"", LegacyHeader},
+		{"0", LegacyHeader},
+		{"1", FixedHeader},
+		{"7", HeaderVersion},
+		{"-1", LegacyHeader},
+		{"x", LegacyHeader},
+	}
+	for _, test := range tests {
+		if version := NegotiateVersion(test.announced); version != test.version {
+			t.Errorf("%q : got %v, want %v", test.announced, version, test.version)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package dto
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// the buffers are pooled by capacity, the largest class holds the data read at once from a connection with its framing.
+// Larger buffers are left to the GC, not to pin the memory of a few big messages
+var bufferClasses = []int{1024, 16 * 1024, 80 * 1024}
+
+var bufferPools = make([]sync.Pool, len(bufferClasses))
+
+// GetBuffer returns an empty buffer with the capacity of at least size bytes
+func GetBuffer(size int) []byte {
+	for i, class := range bufferClasses {
+		if size <= class {
+			if pooled, ok := bufferPools[i].Get().(*[]byte); ok {
+				return (*pooled)[:0]
+			}
+			return make([]byte, 0, class)
+		}
+	}
+	return make([]byte, 0, size)
+}
+
+// Release gives the buffer back to the pool, it must not be used afterwards
+func Release(buffer []byte) {
+	for i := len(bufferClasses) - 1; i >= 0; i-- {
+		if cap(buffer) == bufferClasses[i] {
+			buffer = buffer[:0]
+			bufferPools[i].Put(&buffer)
+			return
+		}
+	}
+}
+
+// ReadFrame reads the reader to the end into a pooled buffer, which the caller releases once done
+func ReadFrame(reader io.Reader) ([]byte, error) {
+	largest := bufferClasses[len(bufferClasses)-1]
+	buffer := GetBuffer(largest)
+	for {
+		if len(buffer) == cap(buffer) {
+			buffer = append(buffer, 0)[:len(buffer)]
+		}
+		n, err := reader.Read(buffer[len(buffer):cap(buffer)])
+		buffer = buffer[:len(buffer)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Release(buffer)
+			return nil, err
+		}
+	}
+
+	// most messages are small, they should not hold a large buffer while queued
+	if len(buffer) <= bufferClasses[len(bufferClasses)-2] {
+		small := append(GetBuffer(len(buffer)), buffer...)
+		Release(buffer)
+		return small, nil
+	}
+	return buffer, nil
+}
+
+// SharedFrame is a pooled buffer which the data of the messages decoded from it are sliced from.
+// The reader holds it while decoding, and it goes back to the pool once the reader and every message are released
+type SharedFrame struct {
+	buffer []byte
+	refs   int32
+}
+
+func NewSharedFrame(buffer []byte) *SharedFrame {
+	return &SharedFrame{
+		buffer: buffer,
+		refs:   1,
+	}
+}
+
+func (this *SharedFrame) retain() {
+	atomic.AddInt32(&this.refs, 1)
+}
+
+func (this *SharedFrame) Release() {
+	if atomic.AddInt32(&this.refs, -1) == 0 {
+		Release(this.buffer)
+	}
+}
@@ -0,0 +1,61 @@
+package dto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func BenchmarkReadFrame(b *testing.B) {
+	frame, err := Encode(Type_INBOUND_DATA, 1, &Payload{Data: make([]byte, 64*1024)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	reader := bytes.NewReader(frame)
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(frame)
+		buffer, err := ReadFrame(reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+		Release(buffer)
+	}
+}
+
+func TestSharedFrame(t *testing.T) {
+	data := []byte("data sliced from the frame")
+	frame, err := Encode(Type_INBOUND_DATA, 1, &Payload{Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := NewSharedFrame(frame)
+	msg, err := DecodeShared(frame, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.frame != shared || shared.refs != 2 {
+		t.Fatalf("the message does not hold the frame, %v references", shared.refs)
+	}
+	shared.Release()
+	if !bytes.Equal(msg.Payload.Data, data) {
+		t.Errorf("got %q after the reader released the frame, want %q", msg.Payload.Data, data)
+	}
+	msg.Release()
+	if shared.refs != 0 {
+		t.Errorf("%v references are left", shared.refs)
+	}
+
+	closed, err := Encode(Type_TCP_CONNECTION_CLOSED, 1, &Payload{ErrorMessage: "closed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared = NewSharedFrame(closed)
+	if msg, err = DecodeShared(closed, shared); err != nil {
+		t.Fatal(err)
+	}
+	if msg.frame != nil || shared.refs != 1 {
+		t.Errorf("a message without data holds the frame, %v references", shared.refs)
+	}
+}
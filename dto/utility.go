@@ -1,26 +1,36 @@
 package dto
 
 import (
+	"encoding/binary"
 	"errors"
 	"io"
 
 	"github.com/golang/protobuf/proto"
 )
 
+// the field number of Payload.Data, which is sliced from the frame instead of being copied
+const payloadDataField = 3
+
 type Message struct {
 	Header  *MessageHeader
 	Payload *Payload
+	frame   *SharedFrame // the data is sliced from, nil if it is not pooled
 }
 
+// Release gives the frame the data is sliced from back to the pool, once the data is no longer used.
+// It is called at most once for a message received, whichever copy of it. A message not released is left to the GC
+func (this Message) Release() {
+	if this.frame != nil {
+		this.frame.Release()
+	}
+}
+
+// Encode frames the message with the latest header in a single pooled buffer, which the one writing it to the network releases
 func Encode(msgType Type, connectionID int64, payload *Payload) ([]byte, error) {
 
-	var payloadBytes []byte
-	var err error
+	payloadLength := 0
 	if payload != nil {
-		payloadBytes, err = proto.Marshal(payload)
-		if err != nil {
-			return nil, err
-		}
+		payloadLength = proto.Size(payload)
 	}
 
 	// TODO : encoding the bytes
@@ -29,40 +39,31 @@ func Encode(msgType Type, connectionID int64, payload *Payload) ([]byte, error)
 		Type:         msgType,
 		ConnectionID: connectionID,
 		Mode:         Mode_NONE,
-		Length:       int32(len(payloadBytes)),
 	}
-	headerBytes, err := proto.Marshal(header)
+	bytes, err := frame(HeaderVersion, header, payloadLength)
 	if err != nil {
 		return nil, err
 	}
-
-	if len(headerBytes) > 255 {
-		return nil, errors.New("Header length should never be greater than 255")
+	if payload != nil {
+		buffer := proto.NewBuffer(bytes)
+		if err = buffer.Marshal(payload); err != nil {
+			Release(bytes)
+			return nil, err
+		}
+		bytes = buffer.Bytes()
 	}
 
-	// header represents the length in little endian
-	bytes := make([]byte, 1, len(headerBytes)+len(payloadBytes)+1)
-	bytes[0] = uint8(len(headerBytes))
-	bytes = append(bytes, headerBytes...)
-	bytes = append(bytes, payloadBytes...)
-
 	return bytes, nil
 }
 
+// DecodeHeader parses the header only, the payload is not touched
 func DecodeHeader(b []byte) (*MessageHeader, error) {
 
 	if len(b) < 1 {
 		return nil, nil
 	}
 
-	headerLength := int(b[0])
-	if len(b) < 1+headerLength {
-		return nil, errors.New("Insufficient buffer to decode")
-	}
-
-	slice := b[1 : headerLength+1]
-	header := &MessageHeader{}
-	err := proto.Unmarshal(slice, header)
+	header, _, err := unframe(b)
 	if err != nil {
 		return nil, err
 	}
@@ -70,6 +71,8 @@ func DecodeHeader(b []byte) (*MessageHeader, error) {
 	return header, nil
 }
 
+// Decode parses the message, the data of the payload is sliced from b without copying.
+// b must not be released while the data is used, see DecodeShared
 func Decode(b []byte) (*Message, error) {
 
 	msg := &Message{}
@@ -77,21 +80,13 @@ func Decode(b []byte) (*Message, error) {
 		return nil, nil
 	}
 
-	headerLength := int(b[0])
-	if len(b) < 1+headerLength {
-		return nil, errors.New("Insufficient buffer to decode")
-	}
-
-	slice := b[1 : headerLength+1]
-	msg.Header = &MessageHeader{}
-	err := proto.Unmarshal(slice, msg.Header)
+	header, slice, err := unframe(b)
 	if err != nil {
 		return nil, err
 	}
+	msg.Header = header
 
-	slice = b[headerLength+1:]
-	msg.Payload = &Payload{}
-	err = proto.Unmarshal(slice, msg.Payload)
+	msg.Payload, err = unmarshalPayload(slice)
 	if err != nil {
 		return nil, err
 	}
@@ -99,8 +94,75 @@ func Decode(b []byte) (*Message, error) {
 	return msg, nil
 }
 
+// DecodeShared parses the message sliced from the frame, which is held until the message is released if it carries data
+func DecodeShared(b []byte, frame *SharedFrame) (*Message, error) {
+	msg, err := Decode(b)
+	if err != nil || msg == nil {
+		return msg, err
+	}
+	if len(msg.Payload.Data) > 0 {
+		frame.retain()
+		msg.frame = frame
+	}
+	return msg, nil
+}
+
+// unmarshalPayload parses the payload, whose data is sliced from b.
+// The other fields are small, they are copied and unmarshalled as usual
+func unmarshalPayload(b []byte) (*Payload, error) {
+	var data []byte
+	var others []byte
+	for rest := b; len(rest) > 0; {
+		tag, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, errors.New("Invalid tag in the payload")
+		}
+		length, valueStart := n, n
+		switch tag & 7 {
+		case 0: // varint
+			_, m := binary.Uvarint(rest[n:])
+			if m <= 0 {
+				return nil, errors.New("Invalid varint in the payload")
+			}
+			length += m
+		case 1: // 64 bits
+			length += 8
+		case 2: // length delimited
+			size, m := binary.Uvarint(rest[n:])
+			if m <= 0 || size > uint64(len(rest)-n-m) {
+				return nil, errors.New("Insufficient buffer to decode the payload")
+			}
+			valueStart = n + m
+			length = valueStart + int(size)
+		case 5: // 32 bits
+			length += 4
+		default:
+			return nil, errors.New("Invalid wire type in the payload")
+		}
+		if length > len(rest) {
+			return nil, errors.New("Insufficient buffer to decode the payload")
+		}
+
+		if tag == payloadDataField<<3|2 {
+			data = rest[valueStart:length]
+		} else {
+			others = append(others, rest[:length]...)
+		}
+		rest = rest[length:]
+	}
+
+	payload := &Payload{}
+	if err := proto.Unmarshal(others, payload); err != nil {
+		return nil, err
+	}
+	payload.Data = data
+	return payload, nil
+}
+
+// ReadMessageAndPayload reads a message from the stream, the data of the payload is copied out of the pooled buffers
 func ReadMessageAndPayload(reader io.Reader, headerLength int) (*MessageHeader, *Payload, error) {
-	headerBytes := make([]byte, headerLength, headerLength)
+	headerBytes := GetBuffer(headerLength)[:headerLength]
+	defer Release(headerBytes)
 	n, err := io.ReadFull(reader, headerBytes)
 	if err != nil {
 		return nil, nil, err
@@ -118,7 +180,8 @@ func ReadMessageAndPayload(reader io.Reader, headerLength int) (*MessageHeader,
 	if header.Length > 1024*1024*10 {
 		return nil, nil, errors.New("Payload size is too large")
 	}
-	payloadBytes := make([]byte, header.Length, header.Length)
+	payloadBytes := GetBuffer(int(header.Length))[:header.Length]
+	defer Release(payloadBytes)
 	n, err = io.ReadFull(reader, payloadBytes)
 	if err != nil {
 		return nil, nil, err
@@ -0,0 +1,68 @@
+package dto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func BenchmarkEncode(b *testing.B) {
+	payload := &Payload{Data: make([]byte, 64*1024)}
+	b.SetBytes(int64(len(payload.Data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		frame, err := Encode(Type_INBOUND_DATA, int64(i), payload)
+		if err != nil {
+			b.Fatal(err)
+		}
+		Release(frame)
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	frame, err := Encode(Type_INBOUND_DATA, 1, &Payload{Data: make([]byte, 64*1024)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	payload := &Payload{
+		Address:      "example.com",
+		Port:         443,
+		Data:         []byte("data"),
+		ErrorCode:    ErrorCode_TIMEOUT,
+		ErrorMessage: "timeout",
+	}
+	frame, err := Encode(Type_UDP_DATAGRAM, 7, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Type != Type_UDP_DATAGRAM || msg.Header.ConnectionID != 7 {
+		t.Errorf("got header %v", msg.Header)
+	}
+	if !proto.Equal(msg.Payload, payload) {
+		t.Errorf("got payload %v, want %v", msg.Payload, payload)
+	}
+	msg.Payload.Data[0] = 'D'
+	if !bytes.Contains(frame, []byte("Data")) {
+		t.Error("the data is copied instead of being sliced from the frame")
+	}
+
+	if _, err = Decode(frame[:len(frame)-1]); err == nil {
+		t.Error("a truncated payload is decoded")
+	}
+}
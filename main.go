@@ -31,7 +31,7 @@ func main() {
 	log.Println("Starting detour proxy instance as", role, "role...")
 
 	if role == config.RoleClient {
-		err := client.Run(config.GetHttpPort(), config.GetSocksPort(), config.GetUrl())
+		err := client.Run(config.GetHttpPort(), config.GetSocksPort(), config.GetMixedPort(), config.GetUrl())
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"../config"
+)
+
+// SourceBinder chooses the local address and the interface of the connections to destinations,
+// so that abuse reports against an address can be traced back to the client node
+type SourceBinder struct {
+	ipv4s  []net.IP
+	ipv6s  []net.IP
+	sticky bool   // the same address for the same client node, round-robin otherwise
+	device string // bound with SO_BINDTODEVICE if not empty
+	next   uint32
+}
+
+func NewSourceBinder(binding config.SourceBinding) *SourceBinder {
+	instance := &SourceBinder{
+		sticky: binding.Mode == config.SourceModeSticky,
+		device: binding.Interface,
+	}
+	for _, ip := range binding.GetAddresses() {
+		if ip.To4() != nil {
+			instance.ipv4s = append(instance.ipv4s, ip)
+		} else {
+			instance.ipv6s = append(instance.ipv6s, ip)
+		}
+	}
+	if len(instance.device) > 0 {
+		if err := checkBindToDevice(instance.device); err != nil {
+			panic(fmt.Sprintf("Unable to bind to interface %v : %v, please check your configuration file", instance.device, err))
+		}
+	}
+	if instance.enabled() {
+		log.Println("Connecting from", binding.Addresses, binding.Mode, "interface", instance.device)
+	}
+	return instance
+}
+
+func (this *SourceBinder) enabled() bool {
+	return len(this.ipv4s) > 0 || len(this.ipv6s) > 0 || len(this.device) > 0
+}
+
+// dialer returns the dialer to connect the remote address for the client node, on "tcp" or "udp".
+// Addresses of the other family are not used, the system chooses if there is none of the same family
+func (this *SourceBinder) dialer(network string, remote net.IP, node string) *net.Dialer {
+	dialer := &net.Dialer{
+		Control: this.control(),
+	}
+	pool := this.ipv6s
+	if remote.To4() != nil {
+		pool = this.ipv4s
+	}
+	if ip := this.pick(pool, node); ip != nil {
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return dialer
+}
+
+// listenUDP opens the socket of a UDP association for the client node.
+// The destinations are not known yet, so it is bound to an IPv4 address if any, an IPv6 one otherwise
+func (this *SourceBinder) listenUDP(node string) (*net.UDPConn, error) {
+	network, address := "udp", ""
+	if ip := this.pick(this.ipv4s, node); ip != nil {
+		network, address = "udp4", net.JoinHostPort(ip.String(), "0")
+	} else if ip := this.pick(this.ipv6s, node); ip != nil {
+		network, address = "udp6", net.JoinHostPort(ip.String(), "0")
+	}
+	listenConfig := &net.ListenConfig{Control: this.control()}
+	conn, err := listenConfig.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// listenTCP listens on an ephemeral port for the remote peer of the client node,
+// on the address the connections to the peer would be made from
+func (this *SourceBinder) listenTCP(remote net.IP, node string) (net.Listener, error) {
+	address := ":0"
+	pool := this.ipv4s
+	if remote != nil && remote.To4() == nil {
+		pool = this.ipv6s
+	}
+	if ip := this.pick(pool, node); ip != nil {
+		address = net.JoinHostPort(ip.String(), "0")
+	}
+	listenConfig := &net.ListenConfig{Control: this.control()}
+	return listenConfig.Listen(context.Background(), "tcp", address)
+}
+
+// control binds the socket to the interface, nil if none is configured
+func (this *SourceBinder) control() func(network, address string, c syscall.RawConn) error {
+	if len(this.device) == 0 {
+		return nil
+	}
+	return bindToDevice(this.device)
+}
+
+// pick chooses an address of the pool for the client node, nil if the pool is empty
+func (this *SourceBinder) pick(pool []net.IP, node string) net.IP {
+	if len(pool) == 0 {
+		return nil
+	}
+	var index uint32
+	if this.sticky && len(node) > 0 {
+		hash := fnv.New32a()
+		hash.Write([]byte(node))
+		index = hash.Sum32() % uint32(len(pool))
+	} else {
+		index = (atomic.AddUint32(&this.next, 1) - 1) % uint32(len(pool))
+	}
+	return pool[index]
+}
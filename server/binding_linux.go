@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+func checkBindToDevice(device string) error {
+	_, err := net.InterfaceByName(device)
+	return err
+}
+
+// bindToDevice sets SO_BINDTODEVICE on the socket before it connects, which requires CAP_NET_RAW
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		controlErr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), device)
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+		return err
+	}
+}
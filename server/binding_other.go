@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errBindToDeviceNotSupported = errors.New("Binding to an interface is only supported on Linux")
+
+func checkBindToDevice(device string) error {
+	return errBindToDeviceNotSupported
+}
+
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errBindToDeviceNotSupported
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../config"
+	"../dto"
+)
+
+// Capacity admits the connections of client nodes within the limits of the exit server.
+// When a limit is hit the connection fails with SERVER_BUSY, so that the broker can try another server
+type Capacity struct {
+	maxConnections        int
+	maxConnectionsPerNode int
+	memoryBudget          int64 // bytes
+	idleTimeout           time.Duration
+	maxLifetime           time.Duration
+	connections           int
+	nodes                 map[string]int // connections by client node
+	memory                int64          // bytes of the buffers and queues in use
+	mutex                 sync.Mutex
+}
+
+// Lease is a connection admitted, and the memory it uses
+type Lease struct {
+	capacity *Capacity
+	node     string
+	memory   int64
+	released bool
+	mutex    sync.Mutex
+}
+
+func NewCapacity(limits config.Limits) *Capacity {
+	return &Capacity{
+		maxConnections:        limits.MaxConnections,
+		maxConnectionsPerNode: limits.MaxConnectionsPerNode,
+		memoryBudget:          limits.GetMemoryBudget(),
+		idleTimeout:           limits.GetIdleTimeout(),
+		maxLifetime:           limits.GetMaxLifetime(),
+		nodes:                 make(map[string]int),
+	}
+}
+
+func serverBusy(format string, args ...interface{}) error {
+	return dto.NewError(dto.ErrorCode_SERVER_BUSY, fmt.Sprintf(format, args...))
+}
+
+// acquire admits a connection of the node which uses the memory from the start
+func (this *Capacity) acquire(node string, memory int64) (*Lease, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.maxConnections > 0 && this.connections >= this.maxConnections {
+		return nil, serverBusy("The server has reached the limit of %v connections", this.maxConnections)
+	}
+	if this.maxConnectionsPerNode > 0 && this.nodes[node] >= this.maxConnectionsPerNode {
+		return nil, serverBusy("Node %v has reached the limit of %v connections on the server", node, this.maxConnectionsPerNode)
+	}
+	if this.memoryBudget > 0 && atomic.LoadInt64(&this.memory)+memory > this.memoryBudget {
+		return nil, serverBusy("The server has used up its memory budget of %v bytes", this.memoryBudget)
+	}
+	this.connections++
+	this.nodes[node]++
+
+	lease := &Lease{
+		capacity: this,
+		node:     node,
+	}
+	lease.use(memory)
+	return lease, nil
+}
+
+// use adds the bytes the connection uses, or subtracts if negative
+func (this *Lease) use(delta int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.released {
+		return
+	}
+	this.memory += delta
+	atomic.AddInt64(&this.capacity.memory, delta)
+}
+
+// release returns the connection and all the memory it uses
+func (this *Lease) release() {
+	this.mutex.Lock()
+	if this.released {
+		this.mutex.Unlock()
+		return
+	}
+	this.released = true
+	atomic.AddInt64(&this.capacity.memory, -this.memory)
+	this.mutex.Unlock()
+
+	capacity := this.capacity
+	capacity.mutex.Lock()
+	defer capacity.mutex.Unlock()
+
+	capacity.connections--
+	if capacity.nodes[this.node]--; capacity.nodes[this.node] <= 0 {
+		delete(capacity.nodes, this.node)
+	}
+}
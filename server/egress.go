@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"../config"
+	"../dto"
+)
+
+const egressResolveTimeout = 10 * time.Second
+
+// EgressPolicy decides the destinations the server connects to for clients.
+// Names are resolved and the addresses are checked, the connection is then made to the addresses checked,
+// so that a name cannot be rebound to a denied address in between
+type EgressPolicy struct {
+	allowedNetworks []*net.IPNet
+	deniedNetworks  []*net.IPNet
+	portRanges      [][2]int
+	blockedDomains  []string
+	resolver        *Resolver
+	upstream        *Upstream
+	binder          *SourceBinder
+}
+
+func NewEgressPolicy(egress config.Egress, resolver *Resolver, upstream *Upstream, binder *SourceBinder) *EgressPolicy {
+	instance := &EgressPolicy{
+		resolver:        resolver,
+		upstream:        upstream,
+		binder:          binder,
+		allowedNetworks: egress.GetAllowedNetworks(),
+		deniedNetworks:  egress.GetDeniedNetworks(),
+		portRanges:      egress.GetPortRanges(),
+	}
+	for _, domain := range egress.BlockedDomains {
+		domain = strings.Trim(strings.ToLower(domain), ".")
+		if len(domain) > 0 {
+			instance.blockedDomains = append(instance.blockedDomains, domain)
+		}
+	}
+	return instance
+}
+
+func notAllowed(format string, args ...interface{}) error {
+	return dto.NewError(dto.ErrorCode_NOT_ALLOWED, fmt.Sprintf(format, args...))
+}
+
+func (this *EgressPolicy) checkPort(port int) error {
+	if len(this.portRanges) == 0 {
+		return nil
+	}
+	for _, portRange := range this.portRanges {
+		if port >= portRange[0] && port <= portRange[1] {
+			return nil
+		}
+	}
+	return notAllowed("Port %v is not allowed by the egress policy", port)
+}
+
+func (this *EgressPolicy) checkDomain(host string) error {
+	host = strings.Trim(strings.ToLower(host), ".")
+	for _, domain := range this.blockedDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return notAllowed("Domain %v is blocked by the egress policy", host)
+		}
+	}
+	return nil
+}
+
+func (this *EgressPolicy) checkIP(ip net.IP) error {
+	for _, network := range this.allowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	for _, network := range this.deniedNetworks {
+		if network.Contains(ip) {
+			return notAllowed("Address %v is denied by the egress policy", ip)
+		}
+	}
+	return nil
+}
+
+// resolve returns the addresses of the host which may be connected on the port
+func (this *EgressPolicy) resolve(host string, port int) ([]net.IP, error) {
+	if err := this.checkPort(port); err != nil {
+		return nil, err
+	}
+	return this.lookup(host)
+}
+
+// lookup returns the addresses of the host which are allowed, whatever the port
+func (this *EgressPolicy) lookup(host string) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		if err := this.checkDomain(host); err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), egressResolveTimeout)
+		defer cancel()
+		var err error
+		if ips, err = this.resolver.lookup(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+
+	allowed := make([]net.IP, 0, len(ips))
+	var err error
+	for _, ip := range ips {
+		if err = this.checkIP(ip); err == nil {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		if err == nil {
+			err = notAllowed("No address of %v is allowed by the egress policy", host)
+		}
+		return nil, err
+	}
+	return allowed, nil
+}
+
+// dial connects to the allowed addresses of the host with Happy Eyeballs, through the upstream proxy if any.
+// The local address is chosen for the client node
+func (this *EgressPolicy) dial(network string, host string, port int, timeout time.Duration, node string) (net.Conn, error) {
+	ips, err := this.resolve(host, port)
+	if err != nil {
+		return nil, err
+	}
+	return dialHappyEyeballs(ips, this.resolver.delay, timeout, func(ctx context.Context, ip net.IP) (net.Conn, error) {
+		return this.upstream.dial(ctx, network, host, ip, port, func(remote net.IP) *net.Dialer {
+			return this.binder.dialer(network, remote, node)
+		})
+	})
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"../config"
+)
+
+func TestCheckIP(t *testing.T) {
+	policy := NewEgressPolicy(config.Egress{}, nil, nil, nil)
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:93.184.216.34", true},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b:1::1", false},
+		{"fd00::1", false},
+	}
+	for _, test := range tests {
+		err := policy.checkIP(net.ParseIP(test.ip))
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%v : got allowed %v, want %v", test.ip, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// dialHappyEyeballs connects to the addresses in order as RFC 8305 describes.
+// An attempt starts each time the delay elapses or the previous attempt fails, the first connection established wins
+// and the others are closed
+func dialHappyEyeballs(ips []net.IP, delay time.Duration, timeout time.Duration, dial func(context.Context, net.IP) (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	results := make(chan result, len(ips))
+	attempt := func(ip net.IP) {
+		conn, err := dial(ctx, ip)
+		results <- result{conn, err}
+	}
+
+	next, pending := 0, 0
+	var err error
+	for {
+		if next < len(ips) {
+			go attempt(ips[next])
+			next++
+			pending++
+		}
+		if pending == 0 {
+			return nil, err
+		}
+
+		var timer <-chan time.Time
+		if next < len(ips) {
+			timer = time.After(delay)
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				go (func(pending int) {
+					// the attempts still running are cancelled, close those which made it anyway
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				})(pending)
+				return r.conn, nil
+			}
+			err = r.err
+		case <-timer:
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+type ListenerMap struct {
+	set   map[int64]net.Listener
+	mutex sync.RWMutex
+}
+
+func NewListenerMap() *ListenerMap {
+	instance := &ListenerMap{}
+	instance.set = make(map[int64]net.Listener)
+	instance.mutex = sync.RWMutex{}
+	return instance
+}
+
+func (this *ListenerMap) add(connID int64, listener net.Listener) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.set[connID] = listener
+}
+
+func (this *ListenerMap) remove(connID int64) net.Listener {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	listener := this.set[connID]
+	if listener != nil {
+		delete(this.set, connID)
+	}
+	return listener
+}
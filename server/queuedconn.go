@@ -0,0 +1,217 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../comm"
+	"../dto"
+)
+
+const (
+	writeQueueLength    = 1024             // messages queued for a connection
+	writeQueueHighWater = 1024 * 1024      // bytes queued before the client is asked to pause
+	writeQueueLowWater  = 256 * 1024       // bytes queued when the client is told to resume
+	writeQueueLimit     = 16 * 1024 * 1024 // bytes queued before the connection is given up, the data in flight arrives after pausing
+	writeStuckTimeout   = 60 * time.Second // how long a write may make no progress
+)
+
+// QueuedConn writes to the destination in its own goroutine, so that a destination which does not read
+// cannot stall the dispatcher. Write() only queues the data, which must not be modified afterwards,
+// WriteMessage() queues the data of a message, which is released once written.
+// The client is asked to pause while too much data is queued, and the reading pauses while the broker asks to.
+// The lease is released once the connection is closed, which happens at latest when its lifetime is over
+type QueuedConn struct {
+	net.Conn
+	connectionID int64
+	transport    comm.Transport
+	lease        *Lease
+	queue        chan dto.Message
+	queued       int64 // bytes in the queue
+	paused       int32
+	pauses       int           // asked by the broker to pause reading
+	resumed      chan struct{} // not nil while the reading is paused, closed once resumed
+	flowMutex    sync.Mutex
+	lastActive   int64 // unix nano of the last data in either direction
+	lifetime     *time.Timer
+	onError      func(error)
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+func NewQueuedConn(connectionID int64, conn net.Conn, transport comm.Transport, lease *Lease, maxLifetime time.Duration, onError func(error)) *QueuedConn {
+	instance := &QueuedConn{
+		Conn:         conn,
+		connectionID: connectionID,
+		transport:    transport,
+		lease:        lease,
+		queue:        make(chan dto.Message, writeQueueLength),
+		onError:      onError,
+		closed:       make(chan struct{}),
+	}
+	instance.touch()
+	if maxLifetime > 0 {
+		instance.lifetime = time.AfterFunc(maxLifetime, func() {
+			instance.fail(dto.NewError(dto.ErrorCode_TIMEOUT, fmt.Sprintf("The connection has lasted for %v", maxLifetime)))
+		})
+	}
+	go instance.write()
+	return instance
+}
+
+func (this *QueuedConn) touch() {
+	atomic.StoreInt64(&this.lastActive, time.Now().UnixNano())
+}
+
+func (this *QueuedConn) idleTime() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&this.lastActive))
+}
+
+func (this *QueuedConn) Write(data []byte) (int, error) {
+	return this.WriteMessage(dto.Message{Payload: &dto.Payload{Data: data}})
+}
+
+// WriteMessage queues the data of the message, the message is released once the data is written.
+// It is left to the garbage collector if the data is not queued
+func (this *QueuedConn) WriteMessage(msg dto.Message) (int, error) {
+	data := msg.Payload.GetData()
+	if len(data) == 0 {
+		msg.Release()
+		return 0, nil // nothing to write, only CloseWhenWritten() queues the message closing the connection
+	}
+	select {
+	case <-this.closed:
+		return 0, dto.NewError(dto.ErrorCode_CONNECTION_NOT_FOUND, "The connection is closed")
+	default:
+	}
+
+	this.touch()
+	queued := atomic.AddInt64(&this.queued, int64(len(data)))
+	if queued > writeQueueLimit {
+		atomic.AddInt64(&this.queued, -int64(len(data)))
+		return 0, dto.NewError(dto.ErrorCode_GENERAL_FAILURE,
+			fmt.Sprintf("Over %v bytes are queued for the connection which is not written fast enough", writeQueueLimit))
+	}
+	select {
+	case this.queue <- msg:
+		this.lease.use(int64(len(data)))
+	default:
+		atomic.AddInt64(&this.queued, -int64(len(data)))
+		return 0, dto.NewError(dto.ErrorCode_GENERAL_FAILURE,
+			fmt.Sprintf("Over %v messages are queued for the connection which is not written fast enough", writeQueueLength))
+	}
+
+	if queued > writeQueueHighWater && atomic.CompareAndSwapInt32(&this.paused, 0, 1) {
+		this.transport.Write(dto.Type_FLOW_PAUSE, this.connectionID, nil)
+	}
+	return len(data), nil
+}
+
+func (this *QueuedConn) write() {
+	for {
+		select {
+		case msg := <-this.queue:
+			if msg.Payload == nil {
+				this.Close()
+				return
+			}
+			data := msg.Payload.Data
+			this.Conn.SetWriteDeadline(time.Now().Add(writeStuckTimeout))
+			_, err := this.Conn.Write(data)
+			msg.Release()
+			queued := atomic.AddInt64(&this.queued, -int64(len(data)))
+			this.lease.use(-int64(len(data)))
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					err = dto.NewError(dto.ErrorCode_TIMEOUT,
+						fmt.Sprintf("The connection is stuck, no data is written in %v", writeStuckTimeout))
+				}
+				this.fail(err)
+				return
+			}
+			if queued <= writeQueueLowWater && atomic.CompareAndSwapInt32(&this.paused, 1, 0) {
+				this.transport.Write(dto.Type_FLOW_RESUME, this.connectionID, nil)
+			}
+
+		case <-this.closed:
+			return
+		}
+	}
+}
+
+// pauseReading holds the data read back until the broker resumes, as it has too much queued for the client
+func (this *QueuedConn) pauseReading() {
+	this.flowMutex.Lock()
+	defer this.flowMutex.Unlock()
+
+	this.pauses++
+	if this.resumed == nil {
+		this.resumed = make(chan struct{})
+	}
+}
+
+func (this *QueuedConn) resumeReading() {
+	this.flowMutex.Lock()
+	defer this.flowMutex.Unlock()
+
+	if this.pauses > 0 {
+		this.pauses--
+	}
+	if this.pauses == 0 && this.resumed != nil {
+		close(this.resumed)
+		this.resumed = nil
+	}
+}
+
+// waitResumed blocks while the reading is paused, until the connection is closed
+func (this *QueuedConn) waitResumed() {
+	this.flowMutex.Lock()
+	resumed := this.resumed
+	this.flowMutex.Unlock()
+
+	if resumed != nil {
+		select {
+		case <-resumed:
+		case <-this.closed:
+		}
+	}
+}
+
+// CloseWhenWritten closes the connection once the data queued is written
+func (this *QueuedConn) CloseWhenWritten() {
+	select {
+	case this.queue <- dto.Message{}:
+	default:
+		go (func() {
+			select {
+			case this.queue <- dto.Message{}:
+			case <-this.closed:
+			}
+		})()
+	}
+}
+
+// fail closes the connection and reports the error, unless it is closed on purpose already
+func (this *QueuedConn) fail(err error) {
+	select {
+	case <-this.closed:
+	default:
+		this.onError(err) // before closing, which would end the reading with a vaguer error
+		this.Close()
+	}
+}
+
+// Close discards the data queued and closes the connection
+func (this *QueuedConn) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+		if this.lifetime != nil {
+			this.lifetime.Stop()
+		}
+		this.lease.release()
+	})
+	return this.Conn.Close()
+}
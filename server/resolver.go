@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"../config"
+)
+
+const (
+	resolverTimeout       = 5 * time.Second // of a query to a nameserver
+	resolverMaxCacheTTL   = time.Hour
+	resolverMinCacheTTL   = 5 * time.Second
+	resolverNegativeTTL   = 30 * time.Second
+	resolverSystemTTL     = time.Minute // the system resolver does not tell the TTL
+	resolverSweepInterval = 10 * time.Minute
+)
+
+// Resolver resolves the names the server connects to. Answers are cached as long as their TTL,
+// and the addresses are ordered by the family preferred
+type Resolver struct {
+	nameservers  []string
+	dohUrl       string
+	hosts        map[string][]net.IP
+	preferFamily string
+	delay        time.Duration // between the connection attempts of Happy Eyeballs
+	httpClient   *http.Client
+	dnsClient    *dns.Client
+	cache        map[string]*resolverCacheEntry
+	mutex        sync.RWMutex
+}
+
+type resolverCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+func NewResolver(resolver config.Resolver) *Resolver {
+	instance := &Resolver{
+		nameservers:  resolver.Nameservers,
+		dohUrl:       resolver.DohUrl,
+		hosts:        make(map[string][]net.IP),
+		preferFamily: resolver.PreferFamily,
+		delay:        resolver.GetHappyEyeballsDelay(),
+		httpClient:   &http.Client{Timeout: resolverTimeout},
+		dnsClient:    &dns.Client{Net: "udp", Timeout: resolverTimeout},
+		cache:        make(map[string]*resolverCacheEntry),
+	}
+	for name, addresses := range resolver.Hosts {
+		name = strings.Trim(strings.ToLower(name), ".")
+		for _, address := range addresses {
+			instance.hosts[name] = append(instance.hosts[name], net.ParseIP(address))
+		}
+		instance.hosts[name] = instance.order(instance.hosts[name])
+	}
+	go (func() {
+		for {
+			time.Sleep(resolverSweepInterval)
+			instance.sweep()
+		}
+	})()
+	return instance
+}
+
+// lookup returns the addresses of the host, ordered to be connected
+func (this *Resolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := strings.Trim(strings.ToLower(host), ".")
+	if ips, ok := this.hosts[name]; ok {
+		return ips, nil
+	}
+
+	this.mutex.RLock()
+	entry := this.cache[name]
+	this.mutex.RUnlock()
+	if entry != nil && time.Now().Before(entry.expires) {
+		return entry.ips, entry.err
+	}
+
+	start := time.Now()
+	ips, ttl, via, err := this.resolve(ctx, name)
+	if err != nil {
+		log.Println("Unable to resolve", name, "via", via, ",", err)
+		if ctx.Err() != nil {
+			return nil, err // not cached, the caller gave up
+		}
+		ttl = resolverNegativeTTL
+	} else {
+		ips = this.order(ips)
+		log.Println("Resolved", name, "to", ips, "via", via, "in", time.Since(start))
+	}
+
+	this.mutex.Lock()
+	this.cache[name] = &resolverCacheEntry{
+		ips:     ips,
+		err:     err,
+		expires: time.Now().Add(ttl),
+	}
+	this.mutex.Unlock()
+	return ips, err
+}
+
+func (this *Resolver) resolve(ctx context.Context, name string) ([]net.IP, time.Duration, string, error) {
+	if len(this.dohUrl) > 0 {
+		ips, ttl, err := this.resolveWith(ctx, name, this.exchangeOverHttps)
+		return ips, ttl, this.dohUrl, err
+	}
+	if len(this.nameservers) > 0 {
+		var err error
+		for _, nameserver := range this.nameservers {
+			var ips []net.IP
+			var ttl time.Duration
+			ips, ttl, err = this.resolveWith(ctx, name, func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+				return this.exchange(ctx, req, nameserver)
+			})
+			if err == nil || ctx.Err() != nil {
+				return ips, ttl, nameserver, err
+			}
+			if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+				return nil, 0, nameserver, err // the other nameservers would tell the same
+			}
+		}
+		return nil, 0, strings.Join(this.nameservers, ","), err
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, 0, "system resolver", err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, resolverSystemTTL, "system resolver", nil
+}
+
+// resolveWith queries A and AAAA records in parallel, the TTL is the minimum of the answers
+func (this *Resolver) resolveWith(ctx context.Context, name string, exchange func(context.Context, *dns.Msg) (*dns.Msg, error)) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	results := make(chan result, len(qtypes))
+	for _, qtype := range qtypes {
+		go (func(qtype uint16) {
+			req := new(dns.Msg)
+			req.SetQuestion(dns.Fqdn(name), qtype)
+			resp, err := exchange(ctx, req)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+				results <- result{err: errors.New(fmt.Sprintf("Nameserver replied %v", dns.RcodeToString[resp.Rcode]))}
+				return
+			}
+			answer := result{ttl: resolverMaxCacheTTL}
+			for _, rr := range resp.Answer {
+				switch record := rr.(type) {
+				case *dns.A:
+					answer.ips = append(answer.ips, record.A)
+				case *dns.AAAA:
+					answer.ips = append(answer.ips, record.AAAA)
+				default:
+					continue
+				}
+				if ttl := time.Duration(rr.Header().Ttl) * time.Second; ttl < answer.ttl {
+					answer.ttl = ttl
+				}
+			}
+			results <- answer
+		})(qtype)
+	}
+
+	var ips []net.IP
+	ttl := resolverMaxCacheTTL
+	var err error
+	for range qtypes {
+		answer := <-results
+		if answer.err != nil {
+			err = answer.err
+			continue
+		}
+		ips = append(ips, answer.ips...)
+		if len(answer.ips) > 0 && answer.ttl < ttl {
+			ttl = answer.ttl
+		}
+	}
+	if len(ips) > 0 {
+		if ttl < resolverMinCacheTTL {
+			ttl = resolverMinCacheTTL
+		}
+		return ips, ttl, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil, 0, err
+}
+
+// exchange sends the query over UDP, and over TCP again if the answer is truncated
+func (this *Resolver) exchange(ctx context.Context, req *dns.Msg, nameserver string) (*dns.Msg, error) {
+	resp, _, err := this.dnsClient.ExchangeContext(ctx, req, nameserver)
+	if err == nil && resp.Truncated {
+		client := &dns.Client{Net: "tcp", Timeout: resolverTimeout}
+		resp, _, err = client.ExchangeContext(ctx, req, nameserver)
+	}
+	return resp, err
+}
+
+// exchangeOverHttps posts the query in wire format, RFC 8484
+func (this *Resolver) exchangeOverHttps(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	req.Id = 0 // recommended for caching by RFC 8484
+	data, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, this.dohUrl, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+	httpResp, err := this.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("POST %v returned HTTP status code : %v", this.dohUrl, httpResp.StatusCode))
+	}
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err = resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// order puts the family preferred first, and then alternates the families as RFC 8305 section 4 suggests
+func (this *Resolver) order(ips []net.IP) []net.IP {
+	var ipv4s, ipv6s []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4s = append(ipv4s, ip)
+		} else {
+			ipv6s = append(ipv6s, ip)
+		}
+	}
+	first, second := ipv6s, ipv4s
+	if this.preferFamily == config.PreferFamilyIPv4 {
+		first, second = ipv4s, ipv6s
+	} else if len(this.preferFamily) == 0 {
+		return ips
+	}
+	ordered := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+func (this *Resolver) sweep() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := time.Now()
+	for name, entry := range this.cache {
+		if now.After(entry.expires) {
+			delete(this.cache, name)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"../dto"
+)
+
+// connections accepted for reverse forwards are numbered apart from those of clients
+var reverseCount uint32 = 0
+var reverseConnectionIdBase int64 = int64(rand.New(rand.NewSource(time.Now().UnixNano())).Int31()) * 4294967296
+
+func newConnectionID() int64 {
+	seq := atomic.AddUint32(&reverseCount, 1)
+	return reverseConnectionIdBase + int64(seq)
+}
+
+// handleReverseListen listens for a client until the client closes the listener.
+// Each connection accepted is opened to the client, and relayed once the client establishes it
+func (this *ProxyServer) handleReverseListen(msg dto.Message) {
+	if msg.Payload == nil || msg.Header == nil {
+		return
+	}
+	listenerID := msg.Header.ConnectionID
+	address := net.JoinHostPort(msg.Payload.Address, strconv.Itoa(int(msg.Payload.Port)))
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		payload := dto.NewErrorPayload(err)
+		this.transport.Write(dto.Type_TCP_CONNECTION_FAILED, listenerID, payload)
+		log.Println("Unable to listen on", address, "for reverse forwarding ,", err.Error())
+		return
+	}
+	this.listeners.add(listenerID, listener)
+	log.Println("Listening on", listener.Addr(), "for reverse forwarding", listenerID)
+
+	bindAddr := listener.Addr().(*net.TCPAddr)
+	payload := &dto.Payload{
+		Address: bindAddr.IP.String(),
+		Port:    int32(bindAddr.Port),
+	}
+	this.transport.Write(dto.Type_TCP_BOUND, listenerID, payload)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// the listener is removed if the client closed it
+			if this.listeners.remove(listenerID) != nil {
+				listener.Close()
+				payload := &dto.Payload{
+					ErrorCode:    dto.ErrorCodeOf(err),
+					ErrorMessage: fmt.Sprintf("No more connection is accepted on %v : %v", address, err.Error()),
+				}
+				this.transport.Write(dto.Type_TCP_CONNECTION_CLOSED, listenerID, payload)
+			}
+			log.Println("Stopped listening on", listener.Addr(), "for reverse forwarding", listenerID)
+			return
+		}
+
+		addr := conn.RemoteAddr().(*net.TCPAddr)
+		lease, err := this.capacity.acquire(msg.Payload.SourceNode, receiveBufferSize)
+		if err != nil {
+			conn.Close()
+			log.Println("Refused the connection from", addr, "for reverse forwarding", listenerID, ",", err.Error())
+			continue
+		}
+
+		// nothing is read before the client is ready to receive
+		connectionID := newConnectionID()
+		this.pendingConnections.add(connectionID, this.newQueuedConn(connectionID, conn, lease))
+		time.AfterFunc(reverseConnectTimeout, func() { this.expireReverseConnection(connectionID) })
+		payload := &dto.Payload{
+			Address:    addr.IP.String(),
+			Port:       int32(addr.Port),
+			ListenerID: listenerID,
+		}
+		this.transport.Write(dto.Type_REVERSE_CONNECT, connectionID, payload)
+	}
+}
+
+// handleReverseEstablished starts relaying the connection accepted for reverse forwarding
+func (this *ProxyServer) handleReverseEstablished(msg dto.Message) {
+	if msg.Header == nil {
+		return
+	}
+	conn, ok := this.pendingConnections.remove(msg.Header.ConnectionID).(*QueuedConn)
+	if !ok {
+		return
+	}
+	this.connections.add(msg.Header.ConnectionID, conn)
+	go this.receive(msg.Header.ConnectionID, conn)
+}
+
+func (this *ProxyServer) handleReverseFailed(msg dto.Message) {
+	if msg.Header == nil {
+		return
+	}
+	conn := this.pendingConnections.remove(msg.Header.ConnectionID)
+	if conn != nil {
+		log.Println("Reverse connection from", conn.RemoteAddr(), "failed :", msg.Payload.GetErrorMessage())
+		conn.Close()
+	}
+}
+
+// expireReverseConnection closes the connection if the client has not established it in time, which releases its lease
+func (this *ProxyServer) expireReverseConnection(connectionID int64) {
+	conn := this.pendingConnections.remove(connectionID)
+	if conn == nil {
+		return
+	}
+	log.Println("Reverse connection from", conn.RemoteAddr(), "is not established by the client within", reverseConnectTimeout)
+	conn.Close()
+	payload := &dto.Payload{
+		ErrorCode:    dto.ErrorCode_TIMEOUT,
+		ErrorMessage: fmt.Sprintf("The connection is not established within %v", reverseConnectTimeout),
+	}
+	this.transport.Write(dto.Type_TCP_CONNECTION_CLOSED, connectionID, payload)
+}
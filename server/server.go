@@ -4,23 +4,47 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/satori/go.uuid"
 
 	"../comm"
+	"../config"
 	"../dto"
 )
 
+// how long a BIND request waits for the peer
+const bindTimeout = 2 * time.Minute
+
+// how long a connection accepted for reverse forwarding waits for the client, as long as the broker waits for its reply
+const reverseConnectTimeout = 30 * time.Second
+
+// the buffer each connection reads the destination with
+const receiveBufferSize = 64 * 1024
+
 type ProxyServer struct {
-	connections *ConnectionMap
-	transport   comm.Transport
+	connections        *ConnectionMap
+	pendingConnections *ConnectionMap // accepted for reverse forwarding, but not established by the client yet
+	udpAssociations    *UdpAssociationMap
+	listeners          *ListenerMap
+	transport          comm.Transport
+	udpIdleTimeout     time.Duration
+	egress             *EgressPolicy
+	capacity           *Capacity
 }
 
 func Run(uri string) error {
 	this := &ProxyServer{}
 	this.connections = NewConnectionMap()
+	this.pendingConnections = NewConnectionMap()
+	this.udpAssociations = NewUdpAssociationMap()
+	this.listeners = NewListenerMap()
+	this.udpIdleTimeout = config.GetUdpIdleTimeout()
+	this.capacity = NewCapacity(config.GetLimits())
+	this.egress = NewEgressPolicy(config.GetEgress(), NewResolver(config.GetResolver()), NewUpstream(config.GetUpstreamProxy()), NewSourceBinder(config.GetSourceBinding()))
 
 	if strings.LastIndex(uri, "?") > 0 {
 		uri += "&"
@@ -29,7 +53,7 @@ func Run(uri string) error {
 	}
 	uri += "r=s&id=" + uuid.NewV4().String()
 
-	transport, err := comm.NewWebSocketTransport(uri)
+	transport, err := comm.NewWebSocketTransport(uri, config.GetBatching(), config.GetScheduling())
 	if err != nil {
 		panic(err)
 	}
@@ -55,6 +79,30 @@ func Run(uri string) error {
 		case dto.Type_TCP_CONNECTION_CLOSED:
 			this.handleDisconnection(msg)
 
+		case dto.Type_DNS_QUERY:
+			go this.handleDnsQuery(msg)
+
+		case dto.Type_UDP_ASSOCIATE:
+			this.handleUdpAssociate(msg)
+
+		case dto.Type_UDP_DATAGRAM:
+			this.handleUdpDatagram(msg)
+
+		case dto.Type_TCP_BIND:
+			go this.handleBind(msg)
+
+		case dto.Type_REVERSE_LISTEN:
+			go this.handleReverseListen(msg)
+
+		case dto.Type_TCP_CONNECTION_ESTABLISHED:
+			this.handleReverseEstablished(msg)
+
+		case dto.Type_TCP_CONNECTION_FAILED:
+			this.handleReverseFailed(msg)
+
+		case dto.Type_FLOW_PAUSE, dto.Type_FLOW_RESUME:
+			this.handleFlow(msg)
+
 		default:
 			log.Println("Unknown type:", msg.Header.Type)
 		}
@@ -69,76 +117,442 @@ func (this *ProxyServer) handleConnect(msg dto.Message) {
 	}
 	address := fmt.Sprintf("%v:%d", msg.Payload.Address, msg.Payload.Port)
 
-	conn, err := net.DialTimeout("tcp", address, 20*time.Second)
+	lease, err := this.capacity.acquire(msg.Payload.SourceNode, receiveBufferSize)
+	if err != nil {
+		payload := dto.NewErrorPayload(err)
+		this.transport.Write(dto.Type_TCP_CONNECTION_FAILED, msg.Header.ConnectionID, payload)
+		log.Println("Refused to dial", address, ",", err.Error())
+		return
+	}
+
+	conn, err := this.egress.dial("tcp", msg.Payload.Address, int(msg.Payload.Port), 20*time.Second, msg.Payload.SourceNode)
 	if err != nil {
 		// handle error
-		payload := &dto.Payload{
-			ErrorMessage: err.Error(),
-		}
+		lease.release()
+		payload := dto.NewErrorPayload(err)
 		this.transport.Write(dto.Type_TCP_CONNECTION_FAILED, msg.Header.ConnectionID, payload)
 		log.Println("Unable to dial", address, ",", err.Error())
 		return
 	}
 
-	this.connections.add(msg.Header.ConnectionID, conn)
+	queuedConn := this.newQueuedConn(msg.Header.ConnectionID, conn, lease)
+	this.connections.add(msg.Header.ConnectionID, queuedConn)
+	logEgress("Connection", msg, "to "+address, conn.LocalAddr().String())
 
-	// connected successfully
-	this.transport.Write(dto.Type_TCP_CONNECTION_ESTABLISHED, msg.Header.ConnectionID, nil)
+	// connected successfully, tell the client the address bound
+	bindAddr := conn.LocalAddr().(*net.TCPAddr)
+	payload := &dto.Payload{
+		Address: bindAddr.IP.String(),
+		Port:    int32(bindAddr.Port),
+	}
+	this.transport.Write(dto.Type_TCP_CONNECTION_ESTABLISHED, msg.Header.ConnectionID, payload)
 	//log.Println(msg.Header.ConnectionID, "connected")
-	data := make([]byte, 1024*512, 1024*512)
+	this.receive(msg.Header.ConnectionID, queuedConn)
+}
+
+// receive forwards the data from the connection until it is closed, or idle for too long
+func (this *ProxyServer) receive(connectionID int64, conn *QueuedConn) {
+	idleTimeout := this.capacity.idleTimeout
+	data := dto.GetBuffer(receiveBufferSize)[:receiveBufferSize] // copied when encoded, reused for each read
+	defer dto.Release(data)
 	for {
+		conn.waitResumed()
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
 		// receive the message
 		n, err := conn.Read(data)
 		if err != nil {
-			payload := &dto.Payload{
-				ErrorMessage: err.Error(),
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && idleTimeout > 0 {
+				if conn.idleTime() < idleTimeout {
+					continue // outbound data keeps it alive
+				}
+				err = dto.NewError(dto.ErrorCode_TIMEOUT, fmt.Sprintf("The connection is idle for %v", idleTimeout))
+			}
+			// the client is told unless it is the one closing
+			if this.connections.remove(connectionID) != nil {
+				conn.Close()
+				payload := dto.NewErrorPayload(err)
+				this.transport.Write(dto.Type_TCP_CONNECTION_CLOSED, connectionID, payload)
 			}
-			this.transport.Write(dto.Type_TCP_CONNECTION_CLOSED, msg.Header.ConnectionID, payload)
 			return
 		}
+		conn.touch()
 
 		if n > 0 {
 			payload := &dto.Payload{
 				Data: data[0:n],
 			}
-			this.transport.Write(dto.Type_INBOUND_DATA, msg.Header.ConnectionID, payload)
+			this.transport.Write(dto.Type_INBOUND_DATA, connectionID, payload)
 		}
 
 	}
 
 }
 
+// newQueuedConn queues the data written to the connection, which is closed if it cannot be written
+func (this *ProxyServer) newQueuedConn(connectionID int64, conn net.Conn, lease *Lease) *QueuedConn {
+	return NewQueuedConn(connectionID, conn, this.transport, lease, this.capacity.maxLifetime, func(err error) {
+		if this.connections.remove(connectionID) != nil || this.pendingConnections.remove(connectionID) != nil {
+			log.Println("Connection", connectionID, "is closed,", err.Error())
+			this.transport.Write(dto.Type_TCP_CONNECTION_CLOSED, connectionID, dto.NewErrorPayload(err))
+		}
+	})
+}
+
+// handleOutbound queues the data, it never blocks the dispatcher
 func (this *ProxyServer) handleOutbound(msg dto.Message) {
 	if msg.Header != nil {
 		conn := this.connections.get(msg.Header.ConnectionID)
 		if conn == nil { // connection has gone
 			payload := &dto.Payload{
+				ErrorCode:    dto.ErrorCode_CONNECTION_NOT_FOUND,
 				ErrorMessage: fmt.Sprintf("Unable to find the connection whose id is %v", msg.Header.ConnectionID),
 			}
 			this.transport.Write(dto.Type_TCP_CONNECTION_CLOSED, msg.Header.ConnectionID, payload)
 		} else { // forward the data
-			_, err := conn.Write(msg.Payload.GetData())
+			var err error
+			if queuedConn, ok := conn.(*QueuedConn); ok {
+				_, err = queuedConn.WriteMessage(msg)
+			} else {
+				_, err = conn.Write(msg.Payload.GetData())
+			}
 			if err == nil {
 				return
 			}
 
 			conn.Close()
 			this.connections.remove(msg.Header.ConnectionID)
-			payload := &dto.Payload{
-				ErrorMessage: err.Error(),
-			}
+			log.Println("Connection", msg.Header.ConnectionID, "is closed,", err.Error())
+			payload := dto.NewErrorPayload(err)
 			this.transport.Write(dto.Type_TCP_CONNECTION_CLOSED, msg.Header.ConnectionID, payload)
 		}
 	}
 
 }
 
+// handleFlow pauses or resumes reading the connection, as asked by the broker which has too much queued for the client
+func (this *ProxyServer) handleFlow(msg dto.Message) {
+	if msg.Header == nil {
+		return
+	}
+	conn, ok := this.connections.get(msg.Header.ConnectionID).(*QueuedConn)
+	if !ok {
+		return
+	}
+	if msg.Header.Type == dto.Type_FLOW_PAUSE {
+		conn.pauseReading()
+	} else {
+		conn.resumeReading()
+	}
+}
+
 func (this *ProxyServer) handleDisconnection(msg dto.Message) {
 	if msg.Header != nil {
 		conn := this.connections.remove(msg.Header.ConnectionID)
+		if queuedConn, ok := conn.(*QueuedConn); ok {
+			queuedConn.CloseWhenWritten() // the data sent before is still delivered
+		} else if conn != nil {
+			conn.Close()
+		}
+		conn = this.pendingConnections.remove(msg.Header.ConnectionID)
 		if conn != nil {
 			conn.Close()
 		}
+		association := this.udpAssociations.remove(msg.Header.ConnectionID)
+		if association != nil {
+			association.conn.Close()
+		}
+		listener := this.listeners.remove(msg.Header.ConnectionID)
+		if listener != nil {
+			listener.Close()
+		}
+	}
+
+}
+
+// handleDnsQuery sends the query to the nameserver specified by the client and replies the answer
+func (this *ProxyServer) handleDnsQuery(msg dto.Message) {
+	if msg.Payload == nil || msg.Header == nil {
+		return
+	}
+	address := net.JoinHostPort(msg.Payload.Address, strconv.Itoa(int(msg.Payload.Port)))
+
+	req := new(dns.Msg)
+	err := req.Unpack(msg.Payload.GetData())
+	var ips []net.IP
+	if err == nil {
+		ips, err = this.egress.resolve(msg.Payload.Address, int(msg.Payload.Port))
+		if err == nil {
+			address = net.JoinHostPort(ips[0].String(), strconv.Itoa(int(msg.Payload.Port)))
+		}
+	}
+	if err == nil {
+		// the query is sent from the address chosen for the client node like its connections
+		client := &dns.Client{
+			Net:    "udp",
+			Dialer: this.egress.binder.dialer("udp", ips[0], msg.Payload.SourceNode),
+		}
+		client.Dialer.Timeout = 10 * time.Second
+		local := this.localAddressTo(ips[0])
+		if client.Dialer.LocalAddr != nil {
+			local = client.Dialer.LocalAddr.(*net.UDPAddr).IP.String()
+		}
+		logEgress("DNS query", msg, "to "+address, local)
+		var resp *dns.Msg
+		resp, _, err = client.Exchange(req, address)
+		if err == nil && resp.Truncated {
+			client.Net = "tcp"
+			client.Dialer = this.egress.binder.dialer("tcp", ips[0], msg.Payload.SourceNode)
+			client.Dialer.Timeout = 10 * time.Second
+			resp, _, err = client.Exchange(req, address)
+		}
+		if err == nil {
+			var data []byte
+			data, err = resp.Pack()
+			if err == nil {
+				payload := &dto.Payload{
+					Data: data,
+				}
+				this.transport.Write(dto.Type_DNS_RESPONSE, msg.Header.ConnectionID, payload)
+				return
+			}
+		}
+	}
+
+	payload := dto.NewErrorPayload(err)
+	this.transport.Write(dto.Type_TCP_CONNECTION_FAILED, msg.Header.ConnectionID, payload)
+	log.Println("Unable to query", address, ",", err.Error())
+}
+
+// handleUdpAssociate opens a UDP socket for the client, which is closed after being idle for a while
+func (this *ProxyServer) handleUdpAssociate(msg dto.Message) {
+	if msg.Header == nil {
+		return
+	}
+	// the buffer receiving the datagrams is used from the start
+	lease, err := this.capacity.acquire(msg.Payload.GetSourceNode(), receiveBufferSize)
+	if err != nil {
+		this.transport.Write(dto.Type_TCP_CONNECTION_FAILED, msg.Header.ConnectionID, dto.NewErrorPayload(err))
+		log.Println("Refused the UDP association of", msg.Payload.GetSourceNode(), ",", err.Error())
+		return
+	}
+	conn, err := this.egress.binder.listenUDP(msg.Payload.GetSourceNode())
+	if err != nil {
+		lease.release()
+		payload := dto.NewErrorPayload(err)
+		this.transport.Write(dto.Type_TCP_CONNECTION_FAILED, msg.Header.ConnectionID, payload)
+		log.Println("Unable to open UDP socket ,", err.Error())
+		return
+	}
+	logEgress("UDP association", msg, "to any address", conn.LocalAddr().String())
+
+	association := &UdpAssociation{
+		conn:  conn,
+		lease: lease,
 	}
+	association.touch()
+	this.udpAssociations.add(msg.Header.ConnectionID, association)
+	this.transport.Write(dto.Type_TCP_CONNECTION_ESTABLISHED, msg.Header.ConnectionID, nil)
+
+	go this.receiveDatagrams(msg.Header.ConnectionID, association)
+}
 
+func (this *ProxyServer) receiveDatagrams(connectionID int64, association *UdpAssociation) {
+	defer (func() {
+		if this.udpAssociations.remove(connectionID) != nil {
+			payload := &dto.Payload{
+				ErrorMessage: "UDP association is closed",
+			}
+			this.transport.Write(dto.Type_TCP_CONNECTION_CLOSED, connectionID, payload)
+		}
+		association.conn.Close()
+		association.lease.release()
+	})()
+
+	data := dto.GetBuffer(64 * 1024)[:64*1024]
+	defer dto.Release(data)
+	for {
+		association.conn.SetReadDeadline(time.Now().Add(this.udpIdleTimeout))
+		n, addr, err := association.conn.ReadFromUDP(data)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() &&
+				association.idleTime() < this.udpIdleTimeout {
+				continue // outbound datagrams keep it alive
+			}
+			return
+		}
+		association.touch()
+
+		payload := &dto.Payload{
+			Address: addr.IP.String(),
+			Port:    int32(addr.Port),
+			Data:    data[0:n],
+		}
+		this.transport.Write(dto.Type_UDP_DATAGRAM, connectionID, payload)
+	}
+}
+
+func (this *ProxyServer) handleUdpDatagram(msg dto.Message) {
+	if msg.Header == nil || msg.Payload == nil {
+		return
+	}
+	association := this.udpAssociations.get(msg.Header.ConnectionID)
+	if association == nil {
+		payload := &dto.Payload{
+			ErrorCode:    dto.ErrorCode_CONNECTION_NOT_FOUND,
+			ErrorMessage: fmt.Sprintf("Unable to find the association whose id is %v", msg.Header.ConnectionID),
+		}
+		this.transport.Write(dto.Type_TCP_CONNECTION_CLOSED, msg.Header.ConnectionID, payload)
+		return
+	}
+	association.touch()
+
+	send := func() {
+		ips, err := this.egress.resolve(msg.Payload.Address, int(msg.Payload.Port))
+		if err != nil {
+			log.Println("Unable to send datagram to", msg.Payload.Address, ",", err.Error())
+			msg.Release()
+			return
+		}
+		addr := &net.UDPAddr{IP: sameFamily(ips, association.conn.LocalAddr().(*net.UDPAddr).IP), Port: int(msg.Payload.Port)}
+		association.conn.WriteToUDP(msg.Payload.GetData(), addr)
+		msg.Release()
+	}
+
+	if net.ParseIP(msg.Payload.Address) != nil {
+		send()
+	} else {
+		go send() // do not block the dispatcher for name resolution
+	}
+}
+
+// handleBind listens on an ephemeral port for one inbound connection from the peer
+func (this *ProxyServer) handleBind(msg dto.Message) {
+	if msg.Payload == nil || msg.Header == nil {
+		return
+	}
+	connectionID := msg.Header.ConnectionID
+	peer := net.JoinHostPort(msg.Payload.Address, strconv.Itoa(int(msg.Payload.Port)))
+
+	// the peer is checked like a destination, except its port which it connects from
+	var expectedIP net.IP
+	if ip := net.ParseIP(msg.Payload.Address); ip == nil || !ip.IsUnspecified() {
+		ips, err := this.egress.lookup(msg.Payload.Address)
+		if err != nil {
+			this.transport.Write(dto.Type_TCP_CONNECTION_FAILED, connectionID, dto.NewErrorPayload(err))
+			log.Println("Unable to bind for", peer, ",", err.Error())
+			return
+		}
+		expectedIP = ips[0]
+	}
+
+	listener, err := this.egress.binder.listenTCP(expectedIP, msg.Payload.SourceNode)
+	if err != nil {
+		payload := dto.NewErrorPayload(err)
+		this.transport.Write(dto.Type_TCP_CONNECTION_FAILED, connectionID, payload)
+		log.Println("Unable to listen for", peer, ",", err.Error())
+		return
+	}
+	logEgress("Binding", msg, "for "+peer, listener.Addr().String())
+	this.listeners.add(connectionID, listener)
+	defer (func() {
+		if this.listeners.remove(connectionID) != nil {
+			listener.Close()
+		}
+	})()
+
+	// tell the client where the peer should connect to
+	publicAddress := config.GetPublicAddress()
+	if bound := listener.Addr().(*net.TCPAddr).IP; len(publicAddress) == 0 && !bound.IsUnspecified() {
+		publicAddress = bound.String()
+	} else if len(publicAddress) == 0 {
+		publicAddress = this.localAddressTo(expectedIP)
+	}
+	payload := &dto.Payload{
+		Address: publicAddress,
+		Port:    int32(listener.Addr().(*net.TCPAddr).Port),
+	}
+	this.transport.Write(dto.Type_TCP_BOUND, connectionID, payload)
+
+	time.AfterFunc(bindTimeout, func() { listener.Close() })
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			payload := &dto.Payload{
+				ErrorCode:    dto.ErrorCodeOf(err),
+				ErrorMessage: fmt.Sprintf("No connection from %v is accepted : %v", peer, err.Error()),
+			}
+			this.transport.Write(dto.Type_TCP_CONNECTION_FAILED, connectionID, payload)
+			return
+		}
+
+		addr := conn.RemoteAddr().(*net.TCPAddr)
+		if expectedIP != nil && !expectedIP.Equal(addr.IP) {
+			log.Println("Rejected", addr, "which connects to the port bound for", peer)
+			conn.Close()
+			continue
+		}
+		if err := this.egress.checkIP(addr.IP); err != nil {
+			log.Println("Rejected", addr, "which connects to the port bound for", peer, ",", err.Error())
+			conn.Close()
+			continue
+		}
+
+		this.listeners.remove(connectionID)
+		listener.Close()
+		lease, err := this.capacity.acquire(msg.Payload.SourceNode, receiveBufferSize)
+		if err != nil {
+			conn.Close()
+			this.transport.Write(dto.Type_TCP_CONNECTION_FAILED, connectionID, dto.NewErrorPayload(err))
+			log.Println("Refused the connection from", addr, "for", peer, ",", err.Error())
+			return
+		}
+		queuedConn := this.newQueuedConn(connectionID, conn, lease)
+		this.connections.add(connectionID, queuedConn)
+
+		payload := &dto.Payload{
+			Address: addr.IP.String(),
+			Port:    int32(addr.Port),
+		}
+		this.transport.Write(dto.Type_TCP_CONNECTION_ESTABLISHED, connectionID, payload)
+		this.receive(connectionID, queuedConn)
+		return
+	}
+}
+
+// logEgress tells the local address a request of the client node leaves from, whether the source is bound or not,
+// so that abuse reports against an address can be traced back to the node.
+// The log is the only record, the requests are not counted
+func logEgress(kind string, msg dto.Message, target string, local string) {
+	log.Println(kind, msg.Header.ConnectionID, "of node", msg.Payload.GetSourceNode(), "at", msg.Payload.GetSourceAddress(),
+		target, "from", local)
+}
+
+// localAddressTo returns the local IP which routes to the address
+func (this *ProxyServer) localAddressTo(ip net.IP) string {
+	host := "8.8.8.8"
+	if ip != nil {
+		host = ip.String()
+	}
+	// no packet is sent by connecting a UDP socket
+	conn, err := net.Dial("udp", net.JoinHostPort(host, "53"))
+	if err != nil {
+		return "0.0.0.0"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// sameFamily returns the first address of the family of the local address, the first one if it is unspecified
+func sameFamily(ips []net.IP, local net.IP) net.IP {
+	if local.IsUnspecified() {
+		return ips[0]
+	}
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (local.To4() != nil) {
+			return ip
+		}
+	}
+	return ips[0]
 }
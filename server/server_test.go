@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"../config"
+	"../dto"
+)
+
+// encodingTransport encodes what is written like the websocket transport, and drops the frame unless it keeps the messages
+type encodingTransport struct {
+	frames   int
+	keep     bool
+	messages []*dto.Message
+}
+
+func (this *encodingTransport) Write(msgType dto.Type, connectionID int64, payload *dto.Payload) error {
+	frame, err := dto.Encode(msgType, connectionID, payload)
+	if err != nil {
+		return err
+	}
+	this.frames++
+	if this.keep {
+		msg, err := dto.Decode(append([]byte(nil), frame...))
+		if err != nil {
+			return err
+		}
+		this.messages = append(this.messages, msg)
+	}
+	dto.Release(frame)
+	return nil
+}
+
+func (this *encodingTransport) RegisterChannel(connectionID int64, channel chan dto.Message) {
+}
+
+func (this *encodingTransport) UnregisterChannel(connectionID int64, channel chan dto.Message) {
+}
+
+// BenchmarkReceive reads the destination and encodes the data for the broker
+func BenchmarkReceive(b *testing.B) {
+	transport := &encodingTransport{}
+	this := &ProxyServer{
+		connections: NewConnectionMap(),
+		transport:   transport,
+		capacity:    NewCapacity(config.Limits{}),
+	}
+	local, remote := net.Pipe()
+	lease, err := this.capacity.acquire("client", 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := this.newQueuedConn(1, local, lease)
+	this.connections.add(1, conn)
+
+	data := make([]byte, receiveBufferSize)
+	go (func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := remote.Write(data); err != nil {
+				return
+			}
+		}
+		remote.Close()
+	})()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	this.receive(1, conn)
+	if transport.frames < b.N {
+		b.Errorf("%v frames are encoded, want %v", transport.frames, b.N)
+	}
+}
+
+func TestReceive(t *testing.T) {
+	transport := &encodingTransport{keep: true}
+	this := &ProxyServer{
+		connections: NewConnectionMap(),
+		transport:   transport,
+		capacity:    NewCapacity(config.Limits{}),
+	}
+	local, remote := net.Pipe()
+	lease, err := this.capacity.acquire("client", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := this.newQueuedConn(1, local, lease)
+	this.connections.add(1, conn)
+
+	// the reads reuse the pooled buffer, each message must keep what was read then
+	var sent []byte
+	written := make(chan struct{})
+	go (func() {
+		defer close(written)
+		for i, size := range []int{1, 4096, receiveBufferSize, 3 * receiveBufferSize / 2, 10} {
+			chunk := bytes.Repeat([]byte{byte('a' + i)}, size)
+			sent = append(sent, chunk...)
+			remote.Write(chunk)
+		}
+		remote.Close()
+	})()
+	this.receive(1, conn)
+	<-written
+
+	var received []byte
+	for _, msg := range transport.messages[:len(transport.messages)-1] {
+		if msg.Header.Type != dto.Type_INBOUND_DATA || msg.Header.ConnectionID != 1 {
+			t.Fatalf("got %v", msg.Header)
+		}
+		if len(msg.Payload.Data) > receiveBufferSize {
+			t.Errorf("%v bytes are sent at once", len(msg.Payload.Data))
+		}
+		received = append(received, msg.Payload.Data...)
+	}
+	if !bytes.Equal(received, sent) {
+		t.Errorf("got %v bytes, want %v bytes as sent", len(received), len(sent))
+	}
+	if last := transport.messages[len(transport.messages)-1]; last.Header.Type != dto.Type_TCP_CONNECTION_CLOSED {
+		t.Errorf("the last message is %v, want the connection closed", last.Header.Type)
+	}
+	if this.connections.get(1) != nil {
+		t.Error("the connection is not removed once closed")
+	}
+}
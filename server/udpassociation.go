@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type UdpAssociation struct {
+	conn       *net.UDPConn
+	lease      *Lease // released once the receiving ends
+	lastActive int64  // unix nano of the last datagram in either direction
+}
+
+func (this *UdpAssociation) touch() {
+	atomic.StoreInt64(&this.lastActive, time.Now().UnixNano())
+}
+
+func (this *UdpAssociation) idleTime() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&this.lastActive))
+}
+
+type UdpAssociationMap struct {
+	set   map[int64]*UdpAssociation
+	mutex sync.RWMutex
+}
+
+func NewUdpAssociationMap() *UdpAssociationMap {
+	instance := &UdpAssociationMap{}
+	instance.set = make(map[int64]*UdpAssociation)
+	instance.mutex = sync.RWMutex{}
+	return instance
+}
+
+func (this *UdpAssociationMap) add(connID int64, association *UdpAssociation) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.set[connID] = association
+}
+
+func (this *UdpAssociationMap) get(connID int64) *UdpAssociation {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	return this.set[connID]
+}
+
+func (this *UdpAssociationMap) remove(connID int64) *UdpAssociation {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	association := this.set[connID]
+	if association != nil {
+		delete(this.set, connID)
+	}
+	return association
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"../config"
+	"../dto"
+	"../socks"
+)
+
+// Upstream decides the proxy each connection of the exit server goes through.
+// The proxy is asked to connect the address checked by the egress policy, not the name, so that it cannot be rebound.
+// SOCKS4a proxies are given the name though, as they are chosen to resolve it, once its addresses are checked
+type Upstream struct {
+	proxy *url.URL // nil if connected directly
+	rules []*upstreamRule
+}
+
+type upstreamRule struct {
+	domains    []string
+	networks   []*net.IPNet
+	portRanges [][2]int
+	proxy      *url.URL // nil if connected directly
+}
+
+func NewUpstream(upstream config.UpstreamProxy) *Upstream {
+	instance := &Upstream{
+		proxy: parseUpstreamUrl(upstream.Url),
+	}
+	for _, rule := range upstream.Rules {
+		r := &upstreamRule{
+			networks:   rule.GetNetworks(),
+			portRanges: rule.GetPortRanges(),
+			proxy:      parseUpstreamUrl(rule.Proxy),
+		}
+		for _, domain := range rule.Domains {
+			domain = strings.Trim(strings.ToLower(domain), ".")
+			if len(domain) > 0 {
+				r.domains = append(r.domains, domain)
+			}
+		}
+		instance.rules = append(instance.rules, r)
+	}
+	if instance.proxy != nil {
+		log.Println("Connecting through upstream proxy", instance.proxy.Scheme+"://"+instance.proxy.Host, "by default")
+	}
+	return instance
+}
+
+func parseUpstreamUrl(value string) *url.URL {
+	if len(value) == 0 || value == config.UpstreamDirect {
+		return nil
+	}
+	proxy, _ := url.Parse(value) // checked by config.GetUpstreamProxy()
+	return proxy
+}
+
+func (this *upstreamRule) matches(host string, ip net.IP, port int) bool {
+	if len(this.domains) > 0 {
+		host = strings.Trim(strings.ToLower(host), ".")
+		matched := false
+		for _, domain := range this.domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(this.networks) > 0 {
+		matched := false
+		for _, network := range this.networks {
+			if network.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(this.portRanges) > 0 {
+		matched := false
+		for _, portRange := range this.portRanges {
+			if port >= portRange[0] && port <= portRange[1] {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// route returns the proxy to connect the destination through, nil if connected directly
+func (this *Upstream) route(host string, ip net.IP, port int) *url.URL {
+	for _, rule := range this.rules {
+		if rule.matches(host, ip, port) {
+			return rule.proxy
+		}
+	}
+	return this.proxy
+}
+
+// dial connects the destination directly or through the proxy, with the dialer for the address connected
+func (this *Upstream) dial(ctx context.Context, network string, host string, ip net.IP, port int, newDialer func(net.IP) *net.Dialer) (net.Conn, error) {
+	address := net.JoinHostPort(ip.String(), fmt.Sprint(port))
+	proxy := this.route(host, ip, port)
+	if proxy == nil {
+		return newDialer(ip).DialContext(ctx, network, address)
+	}
+
+	// the handshake with the proxy must complete within the timeout as well
+	deadline, _ := ctx.Deadline()
+	connect := func(network, address string) (net.Conn, error) {
+		addr, err := net.ResolveTCPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := newDialer(addr.IP).DialContext(ctx, network, addr.String())
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(deadline)
+		return conn, nil
+	}
+
+	var client socks.Client
+	var err error
+	if strings.EqualFold(proxy.Scheme, "http") {
+		client = &httpConnectClient{proxy, connect}
+	} else {
+		client, err = socks.NewClient(proxy, &socks.SOCKSConf{
+			Dial:      connect,
+			TLSConfig: &tls.Config{ServerName: proxy.Hostname()},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if strings.EqualFold(proxy.Scheme, "socks4a") && len(host) > 0 && net.ParseIP(host) == nil {
+		address = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	conn, err := client.Dial(network, address)
+	if err != nil {
+		return nil, dto.NewError(dto.ErrorCodeOf(err), fmt.Sprintf("Unable to connect %v through %v : %v", address, proxy.Host, err))
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// httpConnectClient connects through an HTTP proxy with the CONNECT method
+type httpConnectClient struct {
+	proxy *url.URL
+	dial  func(network, address string) (net.Conn, error)
+}
+
+func (this *httpConnectClient) Dial(network, address string) (net.Conn, error) {
+	conn, err := this.dial("tcp", this.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	req.Header.Set("User-Agent", "") // not to add the default one
+	if this.proxy.User != nil {
+		password, _ := this.proxy.User.Password()
+		credentials := this.proxy.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusProxyAuthRequired {
+			return nil, dto.NewError(dto.ErrorCode_NOT_ALLOWED, fmt.Sprintf("Connection not allowed by the proxy : %v", resp.Status))
+		}
+		if resp.StatusCode == http.StatusGatewayTimeout {
+			return nil, dto.NewError(dto.ErrorCode_TIMEOUT, fmt.Sprintf("The proxy replied : %v", resp.Status))
+		}
+		return nil, errors.New(fmt.Sprintf("The proxy replied : %v", resp.Status))
+	}
+
+	// the destination may have spoken already
+	if reader.Buffered() > 0 {
+		return &bufferedConn{conn, reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes have been read into the reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (this *bufferedConn) Read(b []byte) (int, error) {
+	return this.reader.Read(b)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"../config"
+)
+
+// TestUpstreamSocks4a checks the name is sent to a SOCKS4a proxy and the address to a SOCKS4 one
+func TestUpstreamSocks4a(t *testing.T) {
+	for _, scheme := range []string{"socks4a", "socks4"} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := make(chan []byte, 1)
+		go (func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			request := make([]byte, 64)
+			n, _ := conn.Read(request)
+			received <- request[:n]
+			conn.Write([]byte{0, 90, 0, 0, 0, 0, 0, 0})
+		})()
+
+		upstream := NewUpstream(config.UpstreamProxy{Url: scheme + "://" + listener.Addr().String()})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := upstream.dial(ctx, "tcp", "example.com", net.ParseIP("93.184.216.34"), 80, func(net.IP) *net.Dialer {
+			return &net.Dialer{}
+		})
+		cancel()
+		listener.Close()
+		if err != nil {
+			t.Errorf("%v : %v", scheme, err)
+			continue
+		}
+		conn.Close()
+
+		request := <-received
+		sentName := bytes.Contains(request, []byte("example.com"))
+		sentIP := bytes.Equal(request[4:8], []byte{93, 184, 216, 34})
+		if sentName != (scheme == "socks4a") || sentIP != (scheme == "socks4") {
+			t.Errorf("%v : got request %v", scheme, request)
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package socks
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
 	"strings"
@@ -19,6 +19,9 @@ func (c *socks4Client) Dial(network, address string) (remoteConn net.Conn, err e
 	if err != nil {
 		return
 	}
+	if port == nil {
+		return nil, errAddressTypeNotSupported
+	}
 	request := &socks4Request{
 		command: commandConnect,
 		port:    port,
@@ -26,7 +29,12 @@ func (c *socks4Client) Dial(network, address string) (remoteConn net.Conn, err e
 		userId:  []byte{},
 		fqdn:    host,
 	}
-	if c.isSOCKS4() {
+	if c.proxy.User != nil {
+		request.userId = []byte(c.proxy.User.Username())
+	}
+	if ip := net.ParseIP(string(host)).To4(); ip != nil {
+		request.ip = ip
+	} else if c.isSOCKS4() {
 		request.ip, err = c.lookupIP(string(request.fqdn))
 		if err != nil {
 			return
@@ -37,6 +45,12 @@ func (c *socks4Client) Dial(network, address string) (remoteConn net.Conn, err e
 	if err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			remoteConn.Close()
+			remoteConn = nil
+		}
+	}()
 	if _, err = remoteConn.Write(request.ToPacket()); err != nil {
 		return
 	}
@@ -49,20 +63,16 @@ func (c *socks4Client) Dial(network, address string) (remoteConn net.Conn, err e
 }
 
 func (c *socks4Client) handleConnect(remoteConn net.Conn) (err error) {
-	reader := bufio.NewReader(remoteConn)
-	version, err := reader.ReadByte()
-	if err != nil {
+	// version, status, port and ip, nothing after them is consumed
+	response := make([]byte, 8)
+	if _, err = io.ReadFull(remoteConn, response); err != nil {
 		return
 	}
-	if version != 0 {
+	if response[0] != 0 {
 		err = errVersionError
 		return
 	}
-	code, err := reader.ReadByte()
-	if err != nil {
-		return
-	}
-	if code != socks4StatusGranted {
+	if code := response[1]; code != socks4StatusGranted {
 		switch code {
 		case socks4StatusRejected:
 			err = errors.New("Socks connection request rejected or failed.")
@@ -75,14 +85,6 @@ func (c *socks4Client) handleConnect(remoteConn net.Conn) (err error) {
 		}
 		return
 	}
-	_, err = reader.Discard(2) // dst port
-	if err != nil {
-		return
-	}
-	_, err = reader.Discard(4) // dst ip
-	if err != nil {
-		return
-	}
 	return
 }
 
@@ -99,8 +101,8 @@ func (c *socks4Client) lookupIP(host string) (ip net.IP, err error) {
 		err = fmt.Errorf("Cannot resolve host: %s.", host)
 		return
 	}
-	ip = ips[0]
-	if len(ip) != net.IPv4len {
+	ip = ips[0].To4()
+	if ip == nil {
 		err = errors.New("IPv6 is not supported by SOCKS4.")
 		return
 	}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"crypto/tls"
 	"errors"
+	"io"
 	"net"
 	"net/url"
 	"strings"
@@ -16,29 +17,30 @@ type socks5Client struct {
 }
 
 func (c *socks5Client) Dial(network, address string) (remoteConn net.Conn, err error) {
-	host, port, err := splitHostPort(address)
+	addr, err := newSocks5Addr(address)
 	if err != nil {
 		return
 	}
 	request := &socks5Request{
-		version: socks5version,
-		socks5Addr: &socks5Addr{
-			addrType: socks5AddressTypeFQDN,
-			addr:     append([]byte{byte(len(host))}, host...),
-			port:     port,
-		},
+		version:    socks5version,
+		socks5Addr: addr,
 	}
 	if request.command, err = c.commandByNetwork(network); err != nil {
 		return
 	}
 
-	if remoteConn, err = c.conf.Dial(network, c.proxy.Host); err != nil {
+	if remoteConn, err = c.conf.Dial("tcp", c.proxy.Host); err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			remoteConn.Close()
+			remoteConn = nil
+		}
+	}()
 	if c.isTLS() {
 		tlsConn := tls.Client(remoteConn, c.tlsConfig)
 		if err = tlsConn.Handshake(); err != nil {
-			tlsConn.Close()
 			return
 		}
 		remoteConn = tlsConn
@@ -59,68 +61,70 @@ func (c *socks5Client) Dial(network, address string) (remoteConn net.Conn, err e
 }
 
 func (c *socks5Client) handshake(conn net.Conn) (err error) {
-	method := socks5AuthMethodNoRequired
+	methods := []byte{socks5AuthMethodNoRequired}
 	if c.proxy.User != nil {
-		method = socks5AuthMethodPassword
+		methods = append(methods, socks5AuthMethodPassword)
 	}
 	if c.isTLS() {
-		method += 0x80
+		for i := range methods {
+			methods[i] += 0x80
+		}
 	}
 	request := &socks5InitialRequest{
 		version: socks5version,
-		methods: []byte{method},
+		methods: methods,
 	}
 
 	if _, err = conn.Write(request.ToPacket()); err != nil {
 		return
 	}
 
-	reader := bufio.NewReader(conn)
-	version, err := reader.ReadByte()
-	if err != nil {
+	response := make(socks5InitialResponse, 2)
+	if _, err = io.ReadFull(conn, response); err != nil {
 		return
 	}
-	if version != socks5version {
+	if response.Version() != socks5version {
 		return errVersionError
 	}
-	auth, err := reader.ReadByte()
-	if err != nil {
-		return
-	}
-	switch {
-	case auth == 1 && method == socks5AuthMethodPassword:
-		passed, err := c.passwordAuth(conn)
-		if err != nil {
-			return err
+	switch response.Auth() {
+	case socks5AuthMethodNoRequired, socks5AuthMethodTLSNoRequired:
+	case socks5AuthMethodPassword, socks5AuthMethodTLSPassword:
+		if c.proxy.User == nil {
+			return errAuthMethodNotSupported
 		}
-		if !passed {
-			err = errors.New("password authentication failed.")
-		}
-	case auth != 0 && method == socks5AuthMethodNoRequired:
-		err = errors.New("socks method negotiation failed.")
+		return c.passwordAuth(conn)
+	default:
+		return errAuthMethodNotSupported
 	}
 	return
 }
 
-func (c *socks5Client) passwordAuth(conn net.Conn) (bool, error) {
+// passwordAuth authenticates with the username and password of the proxy URL, RFC 1929
+func (c *socks5Client) passwordAuth(conn net.Conn) error {
 	username := c.proxy.User.Username()
 	password, _ := c.proxy.User.Password()
-	request := []byte{socks5version}
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("username or password too long")
+	}
+	request := []byte{socks5AuthPasswordVersion}
 	request = append(request, byte(len(username)))
 	request = append(request, []byte(username)...)
 	request = append(request, byte(len(password)))
 	request = append(request, []byte(password)...)
 	if _, err := conn.Write(request); err != nil {
-		return false, err
+		return err
 	}
 	response := make([]byte, 2)
-	if _, err := conn.Read(response); err != nil {
-		return false, err
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	if response[0] != socks5AuthPasswordVersion {
+		return errVersionError
 	}
-	if response[0] != 0x01 {
-		return false, errors.New("unexpected auth")
+	if response[1] != socks5AuthPasswordSuccess {
+		return errAuthFailed
 	}
-	return response[1] == 1, nil
+	return nil
 }
 
 func (c *socks5Client) commandByNetwork(network string) (command byte, err error) {
@@ -138,7 +142,7 @@ func (c *socks5Client) commandByNetwork(network string) (command byte, err error
 }
 
 func (c *socks5Client) handleConnect(conn net.Conn) (err error) {
-	reader := bufio.NewReader(conn)
+	reader := bufio.NewReader(byteReader{conn})
 	version, err := reader.ReadByte()
 	if err != nil {
 		return
@@ -150,8 +154,8 @@ func (c *socks5Client) handleConnect(conn net.Conn) (err error) {
 	if err != nil {
 		return
 	}
-	if status != 0 {
-		return errors.New("Can't complete SOCKS5 connection.")
+	if status != socks5StatusSucceeded {
+		return &socks5StatusError{status}
 	}
 	// skip reserved
 	if _, err = reader.Discard(1); err != nil {
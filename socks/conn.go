@@ -11,6 +11,38 @@ type SOCKSConf struct {
 	Dial        func(network, address string) (net.Conn, error)
 	HandleError func(error)
 	TLSConfig   *tls.Config
+
+	// Sniff is optional. It is called before dialing a CONNECT request and may read the first bytes
+	// the application sends to find the name of the server. The bytes read and the name found are returned.
+	// Applications send nothing before the reply, so reply() must be called before reading
+	Sniff func(conn net.Conn, address string, reply func()) ([]byte, string)
+
+	// DialAs is required with Sniff. It dials the address for the name found, which decides the route
+	DialAs func(network, address string, name string) (net.Conn, error)
+
+	// Associate is optional. It opens an association to relay the datagrams of a UDP ASSOCIATE request
+	Associate func() (Association, error)
+
+	// Bind is optional. It listens for the inbound connection of a BIND request
+	Bind func(address string) (Binding, error)
+
+	// StatusOf is optional. It maps the error of dialing to the status of the SOCKS5 reply, one of Socks5Status*
+	StatusOf func(err error) byte
+}
+
+// Binding accepts one connection from the peer of a BIND request.
+// Accept closes the binding when it fails
+type Binding interface {
+	BoundAddress() string
+	Accept() (conn net.Conn, peerAddress string, err error)
+	Close() error
+}
+
+// Association relays datagrams to and from any "host:port"
+type Association interface {
+	WriteTo(data []byte, address string) error
+	ReadFrom() (data []byte, address string, err error)
+	Close() error
 }
 
 func Serve(listener net.Listener, conf *SOCKSConf) {
@@ -27,12 +59,25 @@ func Serve(listener net.Listener, conf *SOCKSConf) {
 	}
 }
 
+// ServeConn serves a connection accepted elsewhere, whose first byte must not have been consumed
+func ServeConn(conn net.Conn, conf *SOCKSConf) {
+	if conf.HandleError == nil {
+		conf.HandleError = func(_ error) {}
+	}
+	handleConn(conn, conf)
+}
+
 func IsSOCKS(r io.Reader) bool {
 	header := make([]byte, 1)
 	if _, err := r.Read(header); err != nil {
 		return false
 	}
-	return header[0] == 4 || header[0] == 5
+	return IsSOCKSVersion(header[0])
+}
+
+// IsSOCKSVersion tells if the first byte of a connection is the version of SOCKS4 or SOCKS5
+func IsSOCKSVersion(header byte) bool {
+	return header == socks4version || header == socks5version
 }
 
 func handleConn(conn net.Conn, conf *SOCKSConf) {
@@ -45,6 +90,15 @@ func handleConn(conn net.Conn, conf *SOCKSConf) {
 	switch buffer[0] {
 	case socks4version:
 		if conf.Auth != nil || conf.TLSConfig != nil {
+			// SOCKS4 cannot authenticate
+			response := &socks4Response{
+				status: socks4StatusRejected,
+				port:   make([]byte, 2),
+				ip:     make([]byte, net.IPv4len),
+			}
+			conn.Write(response.ToPacket())
+			conn.Close()
+			conf.HandleError(errAuthMethodNotSupported)
 			return
 		}
 		socksConn := &socks4Conn{conn, conf}
@@ -61,3 +115,41 @@ func handleConn(conn net.Conn, conf *SOCKSConf) {
 		return
 	}
 }
+
+// dial connects to the address, after letting conf.Sniff find the name of the server if it is set.
+// reply is called once, after dialing unless sniffing needs the application to be replied earlier.
+// In that case a failure can only be told by closing the connection without data
+func dial(conf *SOCKSConf, localConn net.Conn, address string, reply func(net.Conn, error)) (remoteConn net.Conn, err error) {
+	var data []byte
+	name := ""
+	replied := false
+	if conf.Sniff != nil {
+		data, name = conf.Sniff(localConn, address, func() {
+			if !replied {
+				replied = true
+				reply(nil, nil)
+			}
+		})
+	}
+	if len(name) > 0 {
+		remoteConn, err = conf.DialAs("tcp", address, name)
+	} else {
+		remoteConn, err = conf.Dial("tcp", address)
+	}
+	if !replied {
+		reply(remoteConn, err)
+	} else if err != nil {
+		localConn.Close()
+		err = &repliedError{err, socks5StatusOf(conf, err)}
+	}
+	if err != nil {
+		return
+	}
+	if len(data) > 0 {
+		if _, err = remoteConn.Write(data); err != nil {
+			remoteConn.Close()
+			return nil, err
+		}
+	}
+	return
+}
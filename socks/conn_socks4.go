@@ -18,19 +18,23 @@ func (c *socks4Conn) Serve() (err error) {
 	}
 	switch request.command {
 	case commandConnect:
-		c.sendReply(request, socks4StatusGranted)
-		err = c.handleConnect(request.Address())
+		err = c.handleConnect(request)
 	default:
 		err = errCommandNotSupported
-	}
-	if err != nil {
 		c.sendReply(request, socks4StatusRejected)
 	}
 	return
 }
 
-func (c *socks4Conn) handleConnect(host string) (err error) {
-	remoteConn, err := c.conf.Dial("tcp", host)
+// handleConnect replies after dialing, SOCKS4 has no status other than rejected for failures
+func (c *socks4Conn) handleConnect(request *socks4Request) (err error) {
+	remoteConn, err := dial(c.conf, c.localConn, request.Address(), func(remoteConn net.Conn, err error) {
+		if err != nil {
+			c.sendReply(request, socks4StatusRejected)
+		} else {
+			c.sendReply(request, socks4StatusGranted)
+		}
+	})
 	if err != nil {
 		return err
 	}
@@ -50,4 +54,7 @@ func (c *socks4Conn) sendReply(request *socks4Request, status byte) {
 		response.ip = request.ip
 	}
 	c.localConn.Write(response.ToPacket())
+	if status != socks4StatusGranted {
+		c.localConn.Close()
+	}
 }
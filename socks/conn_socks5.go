@@ -4,8 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"io/ioutil"
 	"net"
-	"syscall"
 )
 
 type socks5Conn struct {
@@ -15,7 +15,7 @@ type socks5Conn struct {
 
 func (c *socks5Conn) Serve() (err error) {
 	err = c.handshake()
-	if err == errAuthMethodNotSupported {
+	if err == errAuthMethodNotSupported || err == errAuthFailed {
 		c.localConn.Close()
 		return
 	}
@@ -38,6 +38,8 @@ func (c *socks5Conn) Serve() (err error) {
 		err = c.handleConnect(request)
 	case commandUDPAssociate:
 		err = c.handleUDPAssociate(request)
+	case commandBind:
+		err = c.handleBind(request)
 	default:
 		c.sendReply(request, socks5StatusCommandNotSupported)
 		return errCommandNotSupported
@@ -45,10 +47,19 @@ func (c *socks5Conn) Serve() (err error) {
 	return
 }
 
+// handleConnect replies after dialing, with the address the outbound connection is bound to
 func (c *socks5Conn) handleConnect(request *socks5Request) (err error) {
-	c.sendReply(request, socks5StatusSucceeded)
-	remoteConn, err := c.conf.Dial("tcp", request.Address())
-	if c.sendReplyWithError(request, err) {
+	remoteConn, err := dial(c.conf, c.localConn, request.Address(), func(remoteConn net.Conn, err error) {
+		if c.sendReplyWithError(request, err) {
+			return
+		}
+		bindAddr := c.localConn.LocalAddr()
+		if remoteConn != nil && remoteConn.LocalAddr() != nil {
+			bindAddr = remoteConn.LocalAddr()
+		}
+		c.sendReplyWithAddress(socks5StatusSucceeded, bindAddr.String())
+	})
+	if err != nil {
 		return
 	}
 	go io.Copy(c.localConn, remoteConn)
@@ -57,11 +68,57 @@ func (c *socks5Conn) handleConnect(request *socks5Request) (err error) {
 }
 
 func (c *socks5Conn) handleUDPAssociate(request *socks5Request) (err error) {
-	c.sendUDPReply(request)
-	remoteConn, err := c.conf.Dial("udp", request.Address())
+	if c.conf.Associate == nil {
+		c.sendReply(request, socks5StatusCommandNotSupported)
+		return errCommandNotSupported
+	}
+
+	// the relay listens on the same interface as the TCP connection
+	host, _, err := net.SplitHostPort(c.localConn.LocalAddr().String())
+	if err != nil {
+		c.sendReply(request, socks5StatusGeneral)
+		return
+	}
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host)})
+	if err != nil {
+		c.sendReply(request, socks5StatusGeneral)
+		return
+	}
+	association, err := c.conf.Associate()
 	if c.sendReplyWithError(request, err) {
-		return err
+		relayConn.Close()
+		return
+	}
+
+	c.sendReplyWithAddress(socks5StatusSucceeded, relayConn.LocalAddr().String())
+	relay := newUDPRelay(relayConn, association, c.localConn.RemoteAddr(), request.Address())
+	go relay.outbound()
+	go relay.inbound()
+
+	// the association terminates when the TCP connection does
+	io.Copy(ioutil.Discard, c.localConn)
+	relay.Close()
+	c.localConn.Close()
+	return
+}
+
+// handleBind replies twice, once the port is bound and once the peer connects
+func (c *socks5Conn) handleBind(request *socks5Request) (err error) {
+	if c.conf.Bind == nil {
+		c.sendReply(request, socks5StatusCommandNotSupported)
+		return errCommandNotSupported
 	}
+	binding, err := c.conf.Bind(request.Address())
+	if c.sendReplyWithError(request, err) {
+		return
+	}
+	c.sendReplyWithAddress(socks5StatusSucceeded, binding.BoundAddress())
+
+	remoteConn, peerAddress, err := binding.Accept()
+	if c.sendReplyWithError(request, err) {
+		return
+	}
+	c.sendReplyWithAddress(socks5StatusSucceeded, peerAddress)
 	go io.Copy(c.localConn, remoteConn)
 	go io.Copy(remoteConn, c.localConn)
 	return
@@ -74,7 +131,7 @@ func (c *socks5Conn) handshake() (err error) {
 		return
 	}
 	methods := make([]byte, method)
-	if _, err = reader.Read(methods); err != nil {
+	if _, err = io.ReadFull(reader, methods); err != nil {
 		return
 	}
 	if c.conf.Auth == nil {
@@ -87,6 +144,7 @@ func (c *socks5Conn) handshake() (err error) {
 	return
 }
 
+// authBasedPassword negotiates the username/password authentication defined in RFC 1929
 func (c *socks5Conn) authBasedPassword(methods []byte) (err error) {
 	method := socks5AuthMethodPassword
 	if c.isTLS() {
@@ -100,7 +158,10 @@ func (c *socks5Conn) authBasedPassword(methods []byte) (err error) {
 
 	reader := bufio.NewReader(c.localConn)
 	version, err := reader.ReadByte()
-	if version != 0x01 {
+	if err != nil {
+		return
+	}
+	if version != socks5AuthPasswordVersion {
 		return errAuthMethodNotSupported
 	}
 	usernameLength, err := reader.ReadByte()
@@ -108,7 +169,7 @@ func (c *socks5Conn) authBasedPassword(methods []byte) (err error) {
 		return
 	}
 	username := make([]byte, usernameLength)
-	if _, err = reader.Read(username); err != nil {
+	if _, err = io.ReadFull(reader, username); err != nil {
 		return
 	}
 	passwordLength, err := reader.ReadByte()
@@ -116,28 +177,33 @@ func (c *socks5Conn) authBasedPassword(methods []byte) (err error) {
 		return
 	}
 	password := make([]byte, passwordLength)
-	if _, err = reader.Read(password); err != nil {
+	if _, err = io.ReadFull(reader, password); err != nil {
 		return
 	}
-	if c.conf.Auth(string(username), string(password)) {
-		c.localConn.Write([]byte{0x01, 0x01})
-	} else {
-		c.localConn.Write([]byte{0x01, 0x00})
+	if !c.conf.Auth(string(username), string(password)) {
+		c.localConn.Write([]byte{socks5AuthPasswordVersion, socks5AuthPasswordFailure})
+		return errAuthFailed
 	}
+	c.localConn.Write([]byte{socks5AuthPasswordVersion, socks5AuthPasswordSuccess})
 	return
 }
 
 func (c *socks5Conn) sendReply(request *socks5Request, status byte) {
+	c.sendReplyWithAddress(status, c.localConn.LocalAddr().String())
+}
+
+// sendReplyWithAddress replies with the bound address
+func (c *socks5Conn) sendReplyWithAddress(status byte, address string) {
 	reply := []byte{socks5version, status, 0x00}
-	hostName, hostPort, _ := splitHostPort(c.localConn.LocalAddr().String())
-	ip := net.ParseIP(string(hostName))
-	addrType := socks5AddressTypeIPv4
-	if ip.To16() != nil {
-		addrType = socks5AddressTypeIPv6
-	}
-	reply = append(reply, addrType)
-	reply = append(reply, ip...)
-	reply = append(reply, hostPort...)
+	addr, err := newSocks5Addr(address)
+	if err != nil {
+		addr = &socks5Addr{
+			addrType: socks5AddressTypeIPv4,
+			addr:     make([]byte, net.IPv4len),
+			port:     make([]byte, 2),
+		}
+	}
+	reply = append(reply, addr.ToPacket()...)
 	c.localConn.Write(reply)
 	if status != socks5StatusSucceeded {
 		c.localConn.Close()
@@ -148,26 +214,7 @@ func (c *socks5Conn) sendReplyWithError(request *socks5Request, err error) bool
 	if err == nil {
 		return false
 	}
-	switch err := err.(type) {
-	case net.Error:
-		if err.Timeout() {
-			c.sendReply(request, socks5StatusHostUnreachable)
-		}
-	case *net.OpError:
-		switch err.Op {
-		case "dial":
-			c.sendReply(request, socks5StatusHostUnreachable)
-		case "read":
-			c.sendReply(request, socks5StatusConnectionRefused)
-		}
-	case syscall.Errno:
-		switch err {
-		case syscall.ECONNREFUSED:
-			c.sendReply(request, socks5StatusConnectionRefused)
-		}
-	default:
-		c.sendReply(request, socks5StatusGeneral)
-	}
+	c.sendReply(request, socks5StatusOf(c.conf, err))
 	return true
 }
 
@@ -175,16 +222,6 @@ func (c *socks5Conn) sendAuthReply(status byte) {
 	c.localConn.Write([]byte{socks5version, status})
 }
 
-func (c *socks5Conn) sendUDPReply(request *socks5Request) {
-	reply := []byte{0, 0}
-	fragment := byte(0)
-	reply = append(reply, fragment)
-	reply = append(reply, request.addrType)
-	reply = append(reply, request.addr...)
-	reply = append(reply, request.port...)
-	c.localConn.Write(reply)
-}
-
 func (c *socks5Conn) isTLS() bool {
 	return c.conf.TLSConfig != nil
 }
@@ -7,6 +7,7 @@ const (
 	socks5version byte = 5
 
 	commandConnect      byte = 1
+	commandBind         byte = 2
 	commandUDPAssociate byte = 3
 
 	socks4StatusGranted  byte = 90
@@ -18,8 +19,11 @@ const (
 
 	socks5StatusSucceeded               byte = 0
 	socks5StatusGeneral                 byte = 1
+	socks5StatusNotAllowed              byte = 2
+	socks5StatusNetworkUnreachable      byte = 3
 	socks5StatusHostUnreachable         byte = 4
 	socks5StatusConnectionRefused       byte = 5
+	socks5StatusTTLExpired              byte = 6
 	socks5StatusCommandNotSupported     byte = 7
 	socks5StatusAddressTypeNotSupported byte = 8
 
@@ -28,6 +32,20 @@ const (
 	socks5AuthMethodTLSNoRequired byte = 0x80
 	socks5AuthMethodTLSPassword   byte = 0x82
 	socks5AuthMethodNoAcceptable  byte = 0xFF
+
+	socks5AuthPasswordVersion byte = 0x01
+	socks5AuthPasswordSuccess byte = 0x00
+	socks5AuthPasswordFailure byte = 0x01
+)
+
+// SOCKS5 reply statuses of the failures, returned by SOCKSConf.StatusOf
+const (
+	Socks5StatusGeneral            = socks5StatusGeneral
+	Socks5StatusNotAllowed         = socks5StatusNotAllowed
+	Socks5StatusNetworkUnreachable = socks5StatusNetworkUnreachable
+	Socks5StatusHostUnreachable    = socks5StatusHostUnreachable
+	Socks5StatusConnectionRefused  = socks5StatusConnectionRefused
+	Socks5StatusTTLExpired         = socks5StatusTTLExpired
 )
 
 var (
@@ -35,4 +53,5 @@ var (
 	errCommandNotSupported     = errors.New("command not supported")
 	errAddressTypeNotSupported = errors.New("address type not supported")
 	errAuthMethodNotSupported  = errors.New("authentication method not supported")
+	errAuthFailed              = errors.New("authentication failed")
 )
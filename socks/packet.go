@@ -2,7 +2,10 @@ package socks
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
 )
@@ -105,7 +108,7 @@ func readSocks5Addr(reader *bufio.Reader) (addr *socks5Addr, err error) {
 			length = net.IPv6len
 		}
 		addr.addr = make([]byte, length)
-		if _, err = reader.Read(addr.addr); err != nil {
+		if _, err = io.ReadFull(reader, addr.addr); err != nil {
 			return
 		}
 	case socks5AddressTypeFQDN:
@@ -113,17 +116,98 @@ func readSocks5Addr(reader *bufio.Reader) (addr *socks5Addr, err error) {
 		if err != nil {
 			return nil, err
 		}
-		addr.addr = make([]byte, length)
-		if _, err = reader.Read(addr.addr); err != nil {
+		// the length is kept as the first byte, the same as it is in packets
+		addr.addr = make([]byte, 1+int(length))
+		addr.addr[0] = length
+		if _, err = io.ReadFull(reader, addr.addr[1:]); err != nil {
 			return nil, err
 		}
 	default:
 		return nil, errAddressTypeNotSupported
 	}
 	addr.port = make([]byte, 2)
-	if _, err = reader.Read(addr.port); err != nil {
+	if _, err = io.ReadFull(reader, addr.port); err != nil {
+		return
+	}
+	return
+}
+
+func (addr *socks5Addr) Address() string {
+	var host string
+	switch addr.addrType {
+	case socks5AddressTypeIPv4, socks5AddressTypeIPv6:
+		host = net.IP(addr.addr).String()
+	case socks5AddressTypeFQDN:
+		host = string(addr.addr[1:])
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(addr.port)))
+	return net.JoinHostPort(host, port)
+}
+
+func (addr *socks5Addr) ToPacket() []byte {
+	packet := []byte{addr.addrType}
+	packet = append(packet, addr.addr...)
+	packet = append(packet, addr.port...)
+	return packet
+}
+
+// newSocks5Addr converts "host:port" to the address in a SOCKS5 packet
+func newSocks5Addr(address string) (addr *socks5Addr, err error) {
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return
+	}
+	if port == nil {
+		return nil, errAddressTypeNotSupported
+	}
+	addr = &socks5Addr{port: port}
+	ip := net.ParseIP(string(host))
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return nil, errAddressTypeNotSupported
+		}
+		addr.addrType = socks5AddressTypeFQDN
+		addr.addr = append([]byte{byte(len(host))}, host...)
+	case ip.To4() != nil:
+		addr.addrType = socks5AddressTypeIPv4
+		addr.addr = ip.To4()
+	default:
+		addr.addrType = socks5AddressTypeIPv6
+		addr.addr = ip.To16()
+	}
+	return
+}
+
+// socks5UDPDatagram is the header and data of a datagram exchanged with the UDP relay
+type socks5UDPDatagram struct {
+	fragment byte
+	*socks5Addr
+	data []byte
+}
+
+func (datagram *socks5UDPDatagram) ToPacket() []byte {
+	packet := []byte{0x00, 0x00, datagram.fragment}
+	packet = append(packet, datagram.socks5Addr.ToPacket()...)
+	packet = append(packet, datagram.data...)
+	return packet
+}
+
+func readSocks5UDPDatagram(packet []byte) (datagram *socks5UDPDatagram, err error) {
+	reader := bufio.NewReader(bytes.NewReader(packet))
+	datagram = &socks5UDPDatagram{}
+	// skip reserved
+	if _, err = reader.Discard(2); err != nil {
 		return
 	}
+	if datagram.fragment, err = reader.ReadByte(); err != nil {
+		return
+	}
+	if datagram.socks5Addr, err = readSocks5Addr(reader); err != nil {
+		return
+	}
+	// the reader buffers 4096 bytes only, the rest of the datagram is still in the packet
+	datagram.data, err = ioutil.ReadAll(reader)
 	return
 }
 
@@ -165,18 +249,6 @@ func (request *socks5Request) ToPacket() []byte {
 	return packet
 }
 
-func (request *socks5Request) Address() string {
-	var host string
-	switch request.addrType {
-	case socks5AddressTypeIPv4, socks5AddressTypeIPv6:
-		host = net.IP(request.addr).String()
-	case socks5AddressTypeFQDN:
-		host = string(request.addr)
-	}
-	port := strconv.Itoa(int(binary.BigEndian.Uint16(request.port)))
-	return net.JoinHostPort(host, port)
-}
-
 func readSocks5Request(conn net.Conn) (request *socks5Request, err error) {
 	reader := bufio.NewReader(conn)
 	request = &socks5Request{}
@@ -0,0 +1,32 @@
+package socks
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadSocks5UDPDatagram(t *testing.T) {
+	for _, size := range []int{0, 1, 4096, 8192, 65000} {
+		addr, err := newSocks5Addr("example.com:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		sent := &socks5UDPDatagram{socks5Addr: addr, data: data}
+
+		datagram, err := readSocks5UDPDatagram(sent.ToPacket())
+		if err != nil {
+			t.Errorf("%v bytes : %v", size, err)
+			continue
+		}
+		if datagram.Address() != "example.com:53" {
+			t.Errorf("%v bytes : got address %v", size, datagram.Address())
+		}
+		if !bytes.Equal(datagram.data, data) {
+			t.Errorf("%v bytes : got %v bytes of data", size, len(datagram.data))
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// socks5StatusOf maps the error of dialing to the reply status by conf.StatusOf if it is set.
+// Otherwise only the failures replied by an upstream SOCKS5 server keep their status
+func socks5StatusOf(conf *SOCKSConf, err error) byte {
+	if conf.StatusOf != nil {
+		return conf.StatusOf(err)
+	}
+	var statusErr *socks5StatusError
+	if errors.As(err, &statusErr) && statusErr.Unwrap() != nil {
+		return statusErr.status
+	}
+	return socks5StatusGeneral
+}
+
+// socks5StatusError is the failure replied by an upstream SOCKS5 server
+type socks5StatusError struct {
+	status byte
+}
+
+func (e *socks5StatusError) Error() string {
+	switch e.status {
+	case socks5StatusNotAllowed:
+		return "socks5: connection not allowed by ruleset"
+	case socks5StatusNetworkUnreachable:
+		return "socks5: network is unreachable"
+	case socks5StatusHostUnreachable:
+		return "socks5: host is unreachable"
+	case socks5StatusConnectionRefused:
+		return "socks5: connection refused"
+	case socks5StatusTTLExpired:
+		return "socks5: TTL expired, connection timed out"
+	case socks5StatusCommandNotSupported:
+		return "socks5: command not supported"
+	case socks5StatusAddressTypeNotSupported:
+		return "socks5: address type not supported"
+	}
+	return "socks5: general failure"
+}
+
+// Unwrap returns the system error matching the status, so that the failure is classified as if it happened here
+func (e *socks5StatusError) Unwrap() error {
+	switch e.status {
+	case socks5StatusNotAllowed:
+		return syscall.EACCES
+	case socks5StatusNetworkUnreachable:
+		return syscall.ENETUNREACH
+	case socks5StatusHostUnreachable:
+		return syscall.EHOSTUNREACH
+	case socks5StatusConnectionRefused:
+		return syscall.ECONNREFUSED
+	case socks5StatusTTLExpired:
+		return syscall.ETIMEDOUT
+	}
+	return nil
+}
+
+// repliedError is a failure to dial after the application was replied it succeeded,
+// it tells the status the application would have been replied
+type repliedError struct {
+	err    error
+	status byte
+}
+
+func (e *repliedError) Error() string {
+	return fmt.Sprintf("%v, closed after replying early instead of replying status %v", e.err, e.status)
+}
+
+func (e *repliedError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,29 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSocks5StatusOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status byte
+	}{
+		{"upstream", fmt.Errorf("upstream : %w", &socks5StatusError{socks5StatusNetworkUnreachable}), socks5StatusNetworkUnreachable},
+		{"upstream command", &socks5StatusError{socks5StatusCommandNotSupported}, socks5StatusGeneral},
+		{"unknown", errors.New("host is unreachable"), socks5StatusGeneral},
+	}
+	for _, test := range tests {
+		if status := socks5StatusOf(&SOCKSConf{}, test.err); status != test.status {
+			t.Errorf("%v : got %v, want %v", test.name, status, test.status)
+		}
+	}
+
+	conf := &SOCKSConf{StatusOf: func(error) byte { return socks5StatusNotAllowed }}
+	if status := socks5StatusOf(conf, errors.New("denied")); status != socks5StatusNotAllowed {
+		t.Errorf("StatusOf : got %v, want %v", status, socks5StatusNotAllowed)
+	}
+}
@@ -0,0 +1,109 @@
+package socks
+
+import (
+	"net"
+	"sync"
+)
+
+// udpRelay exchanges SOCKS5 UDP datagrams with the application, and plain datagrams with the association
+type udpRelay struct {
+	relayConn   *net.UDPConn
+	association Association
+	clientIP    net.IP       // only the host of the TCP connection may use the relay
+	clientAddr  *net.UDPAddr // learned from the first datagram if not specified in the request
+	mutex       sync.RWMutex
+	closeOnce   sync.Once
+}
+
+func newUDPRelay(relayConn *net.UDPConn, association Association, tcpAddr net.Addr, requestAddress string) *udpRelay {
+	relay := &udpRelay{
+		relayConn:   relayConn,
+		association: association,
+	}
+	if addr, ok := tcpAddr.(*net.TCPAddr); ok {
+		relay.clientIP = addr.IP
+	}
+
+	// the application may tell the address it sends datagrams from
+	if addr, err := net.ResolveUDPAddr("udp", requestAddress); err == nil &&
+		addr.Port != 0 && addr.IP != nil && !addr.IP.IsUnspecified() {
+		relay.clientAddr = addr
+	}
+	return relay
+}
+
+// outbound forwards datagrams from the application
+func (relay *udpRelay) outbound() {
+	defer relay.Close()
+
+	buffer := make([]byte, 64*1024)
+	for {
+		n, addr, err := relay.relayConn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !relay.accept(addr) {
+			continue
+		}
+		datagram, err := readSocks5UDPDatagram(buffer[:n])
+		if err != nil || datagram.fragment != 0 { // fragmentation is not supported
+			continue
+		}
+		if err = relay.association.WriteTo(datagram.data, datagram.Address()); err != nil {
+			return
+		}
+	}
+}
+
+// inbound forwards datagrams to the application
+func (relay *udpRelay) inbound() {
+	defer relay.Close()
+
+	for {
+		data, address, err := relay.association.ReadFrom()
+		if err != nil {
+			return
+		}
+
+		relay.mutex.RLock()
+		clientAddr := relay.clientAddr
+		relay.mutex.RUnlock()
+		if clientAddr == nil {
+			continue // the application has not sent anything yet
+		}
+
+		addr, err := newSocks5Addr(address)
+		if err != nil {
+			continue
+		}
+		datagram := &socks5UDPDatagram{
+			socks5Addr: addr,
+			data:       data,
+		}
+		if _, err = relay.relayConn.WriteToUDP(datagram.ToPacket(), clientAddr); err != nil {
+			return
+		}
+	}
+}
+
+// accept tells if the datagram comes from the application, and remembers its address
+func (relay *udpRelay) accept(addr *net.UDPAddr) bool {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+
+	if relay.clientAddr != nil {
+		return relay.clientAddr.IP.Equal(addr.IP) && relay.clientAddr.Port == addr.Port
+	}
+	if relay.clientIP != nil && !relay.clientIP.Equal(addr.IP) {
+		return false
+	}
+	relay.clientAddr = addr
+	return true
+}
+
+func (relay *udpRelay) Close() {
+	relay.closeOnce.Do(func() {
+		relay.relayConn.Close()
+		relay.association.Close()
+	})
+}
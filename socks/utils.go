@@ -1,6 +1,7 @@
 package socks
 
 import (
+	"io"
 	"strconv"
 
 	"encoding/binary"
@@ -14,3 +15,15 @@ func toPort(port string) (buffer []byte) {
 	}
 	return nil
 }
+
+// byteReader reads a byte at a time, so that a bufio.Reader on it never consumes data after a reply
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.Reader.Read(p)
+}